@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3Options holds the flags configuring the S3 client, which can point at
+// S3 compatible stores such as MinIO or LocalStack.
+type s3Options struct {
+	region     *string
+	endpoint   *string
+	pathStyle  *bool
+	disableSSL *bool
+	accessKey  *string
+	secretKey  *string
+	profile    *string
+}
+
+// addS3Flags defines the S3 client flags on fs.
+func addS3Flags(fs *flag.FlagSet) *s3Options {
+	return &s3Options{
+		region:     fs.String("region", "", "AWS Region. Defaults to the region of the profile or environment, then us-east-1."),
+		endpoint:   fs.String("endpoint", "", "S3 compatible endpoint URL, e.g. http://localhost:9000 for MinIO, instead of AWS."),
+		pathStyle:  fs.Bool("pathStyle", false, "Address buckets by path rather than by host name, as most S3 compatible stores require."),
+		disableSSL: fs.Bool("disableSSL", false, "Connect to S3 without TLS."),
+		accessKey:  fs.String("accessKey", "", "Static access key ID, instead of the default AWS credential chain."),
+		secretKey:  fs.String("secretKey", "", "Static secret access key, used with -accessKey."),
+		profile:    fs.String("profile", "", "Profile in the shared AWS credentials and config files."),
+	}
+}
+
+// apply copies the S3 options to m.
+func (o *s3Options) apply(m *Main) {
+	m.AWSRegion = *o.region
+	m.S3Endpoint = *o.endpoint
+	m.S3PathStyle = *o.pathStyle
+	m.S3DisableSSL = *o.disableSSL
+	m.AWSAccessKey = *o.accessKey
+	m.AWSSecretKey = *o.secretKey
+	m.AWSProfile = *o.profile
+}
+
+// s3Service returns the S3 service client, creating it on first use.
+func (m *Main) s3Service() (*s3.S3, error) {
+	if m.S3svc != nil {
+		return m.S3svc, nil
+	}
+
+	cfg := aws.Config{}
+	if m.AWSRegion != "" {
+		cfg.Region = aws.String(m.AWSRegion)
+	}
+	if m.S3Endpoint != "" {
+		cfg.Endpoint = aws.String(m.S3Endpoint)
+	}
+	if m.S3PathStyle {
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	if m.S3DisableSSL {
+		cfg.DisableSSL = aws.Bool(true)
+	}
+	if m.AWSAccessKey != "" || m.AWSSecretKey != "" {
+		if m.AWSAccessKey == "" || m.AWSSecretKey == "" {
+			return nil, fmt.Errorf("Static S3 credentials need both an access key and a secret key")
+		}
+		if m.AWSProfile != "" {
+			return nil, fmt.Errorf("Static S3 credentials cannot be used with a profile")
+		}
+		cfg.Credentials = credentials.NewStaticCredentials(m.AWSAccessKey, m.AWSSecretKey, "")
+	}
+
+	// Initialize S3 client
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            cfg,
+		Profile:           m.AWSProfile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Creating S3 session: %v", err)
+	}
+
+	// Create S3 service client, in us-east-1 when neither the flags, the
+	// profile nor the environment name a region.
+	if aws.StringValue(sess.Config.Region) == "" {
+		m.S3svc = s3.New(sess, aws.NewConfig().WithRegion("us-east-1"))
+	} else {
+		m.S3svc = s3.New(sess)
+	}
+	return m.S3svc, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// versionFormat is the date layout of the default index version.
+const versionFormat = "20060102"
+
+// cutoverTopN is the number of rows checked with TopN before a cutover.
+const cutoverTopN = 10
+
+var versionRE = regexp.MustCompile(`^[0-9]+$`)
+
+// versionedIndex returns the name of a version of the base index.
+func versionedIndex(base, version string) (string, error) {
+	if !versionRE.MatchString(version) {
+		return "", fmt.Errorf("Index version %q must be all digits, e.g. a date like 20261017", version)
+	}
+	return base + "_" + version, nil
+}
+
+// mismatchError is returned by cutover when the loaded index fails
+// verification.
+type mismatchError struct {
+	index  string
+	failed int
+}
+
+func (e *mismatchError) Error() string {
+	return fmt.Sprintf("%s failed %d checks", e.index, e.failed)
+}
+
+// checkVersion refuses to load into the version the pointer names, or into
+// a version which already exists, unless Overwrite is set. A resumed load
+// may continue into the version it started.
+func (m *Main) checkVersion() error {
+	if m.Overwrite {
+		return nil
+	}
+	current, err := m.readPointer()
+	if err != nil {
+		return err
+	}
+	if current == m.IndexName {
+		return fmt.Errorf("Index pointer %s already names %s, use -overwrite to load into it", m.PointerPath, m.IndexName)
+	}
+	if m.Resume {
+		return nil
+	}
+	if err := m.connectPilosa(); err != nil {
+		return err
+	}
+	schema, err := m.client.Schema()
+	if err != nil {
+		return fmt.Errorf("Reading schema: %v", err)
+	}
+	if _, ok := schema.Indexes()[m.IndexName]; ok {
+		return fmt.Errorf("Index %s already exists, use -resume to continue loading it or -overwrite to load into it", m.IndexName)
+	}
+	return nil
+}
+
+// cutover completes a blue/green load: it checks the freshly loaded
+// version of the index against StatsPath, or else the source files, points
+// PointerPath at it and deletes all but the newest Keep versions. The
+// version the pointer named before is kept, so the cutover can be rolled
+// back by hand. A *mismatchError is returned if verification fails, and
+// errStopped if the loader is stopped first, leaving the pointer
+// unchanged.
+func (m *Main) cutover() error {
+	if m.mapping != nil {
+		log.Printf("Not verifying %s: verification covers the built in frames only", m.IndexName)
+	} else {
+		var stats *Stats
+		var err error
+		if m.StatsPath != "" {
+			stats, err = LoadStats(m.StatsPath)
+		} else {
+			// Every file is read again, including those a resumed
+			// load skipped.
+			m.checkpoint = nil
+			stats, err = m.sourceStats()
+		}
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(os.Stdout)
+		failed, err := m.verify(w, stats, cutoverTopN)
+		w.Flush()
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return &mismatchError{index: m.IndexName, failed: failed}
+		}
+		log.Printf("Verified %s against %d records", m.IndexName, stats.Records)
+	}
+	if m.Stopped() {
+		return errStopped
+	}
+
+	previous, err := m.readPointer()
+	if err != nil {
+		return err
+	}
+	if err := m.writePointer(m.IndexName); err != nil {
+		return err
+	}
+	if previous != "" {
+		log.Printf("Switched %s from %s to %s", m.PointerPath, previous, m.IndexName)
+	} else {
+		log.Printf("Pointed %s at %s", m.PointerPath, m.IndexName)
+	}
+	return m.collectVersions(previous)
+}
+
+// readPointer returns the index named by PointerPath, or "" if it does not
+// exist yet.
+func (m *Main) readPointer() (string, error) {
+	var data []byte
+	if bucket, key, ok := parseS3URL(m.PointerPath); ok {
+		svc, err := m.s3Service()
+		if err != nil {
+			return "", err
+		}
+		out, err := getObject(svc, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchKey" {
+			return "", nil
+		} else if err != nil {
+			return "", fmt.Errorf("Reading index pointer %s: %v", m.PointerPath, err)
+		}
+		defer out.Body.Close()
+		if data, err = ioutil.ReadAll(out.Body); err != nil {
+			return "", fmt.Errorf("Reading index pointer %s: %v", m.PointerPath, err)
+		}
+	} else {
+		var err error
+		data, err = ioutil.ReadFile(m.PointerPath)
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", fmt.Errorf("Reading index pointer: %v", err)
+		}
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writePointer replaces the contents of PointerPath with the index name.
+// A local pointer is written to a temporary file and renamed into place,
+// and an S3 object is replaced by a single put, so readers see either the
+// old or the new name.
+func (m *Main) writePointer(index string) error {
+	data := []byte(index + "\n")
+	if bucket, key, ok := parseS3URL(m.PointerPath); ok {
+		svc, err := m.s3Service()
+		if err != nil {
+			return err
+		}
+		_, err = svc.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(data),
+			ContentType: aws.String("text/plain"),
+		})
+		if err != nil {
+			return fmt.Errorf("Writing index pointer %s: %v", m.PointerPath, err)
+		}
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(m.PointerPath), filepath.Base(m.PointerPath))
+	if err != nil {
+		return fmt.Errorf("Writing index pointer: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Writing index pointer: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Writing index pointer: %v", err)
+	}
+	return os.Rename(tmp.Name(), m.PointerPath)
+}
+
+// collectVersions deletes the versions of the base index older than the
+// newest Keep, sparing the current index and keep.
+func (m *Main) collectVersions(keep string) error {
+	schema, err := m.client.Schema()
+	if err != nil {
+		return fmt.Errorf("Reading schema: %v", err)
+	}
+	var versions []string
+	for name := range schema.Indexes() {
+		if strings.HasPrefix(name, m.BaseIndex+"_") && versionRE.MatchString(strings.TrimPrefix(name, m.BaseIndex+"_")) {
+			versions = append(versions, name)
+		}
+	}
+	// Versions sort oldest first by length, then digits.
+	sort.Slice(versions, func(i, j int) bool {
+		if len(versions[i]) != len(versions[j]) {
+			return len(versions[i]) < len(versions[j])
+		}
+		return versions[i] < versions[j]
+	})
+
+	indexes := schema.Indexes()
+	for i, name := range versions {
+		if i >= len(versions)-m.Keep || name == m.IndexName || name == keep {
+			continue
+		}
+		if err := m.client.DeleteIndex(indexes[name]); err != nil {
+			return fmt.Errorf("Deleting old index %s: %v", name, err)
+		}
+		log.Printf("Deleted old index %s", name)
+	}
+	return nil
+}
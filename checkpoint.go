@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Progress records how far loading of a single object has got.
+type Progress struct {
+	// Lines is the number of lines read from the start of the object.
+	Lines int64 `json:"lines"`
+	Done  bool  `json:"done"`
+}
+
+// Checkpoint records which objects have been loaded, and how many lines of
+// partially loaded objects, so that an interrupted load can be resumed.
+// It is only saved once the indexer has been closed, so that it never
+// records lines which were read but not yet imported. A load which dies
+// without closing the indexer starts again from the last saved checkpoint.
+// A nil *Checkpoint is valid and records nothing.
+type Checkpoint struct {
+	path    string
+	mu      sync.Mutex
+	objects map[string]*Progress
+}
+
+// OpenCheckpoint returns a checkpoint which is saved to path. When resume
+// is set, the progress of a previous run is read from path if it exists.
+func OpenCheckpoint(path string, resume bool) (*Checkpoint, error) {
+	c := &Checkpoint{
+		path:    path,
+		objects: make(map[string]*Progress),
+	}
+	if !resume {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Reading checkpoint %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &c.objects); err != nil {
+		return nil, fmt.Errorf("Parsing checkpoint %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Start returns the progress of the object named key, which the caller
+// updates as lines are read.
+func (c *Checkpoint) Start(key string) *Progress {
+	if c == nil {
+		return &Progress{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.objects[key]
+	if !ok {
+		p = &Progress{}
+		c.objects[key] = p
+	}
+	return p
+}
+
+// SetLines records that n lines of the object have been read.
+func (p *Progress) SetLines(n int64) {
+	atomic.StoreInt64(&p.Lines, n)
+}
+
+// Complete marks the object named key as fully loaded.
+func (c *Checkpoint) Complete(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.objects[key].Done = true
+	c.mu.Unlock()
+}
+
+// Save atomically writes the checkpoint to its file.
+func (c *Checkpoint) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	snapshot := make(map[string]Progress, len(c.objects))
+	for key, p := range c.objects {
+		snapshot[key] = Progress{Lines: atomic.LoadInt64(&p.Lines), Done: p.Done}
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Writing checkpoint: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Writing checkpoint: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Writing checkpoint: %v", err)
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	u "github.com/travisturner/pilosa-loader/user"
+)
+
+// resolveCountry returns the row of the user's registered country in the
+// country frame, normalizing Registered_country to its alpha-2 code.
+// Unknown countries are counted and, if configured, sent to the dead
+// letter output; the rest of the user is still indexed.
+func (m *Main) resolveCountry(user *u.User) (uint64, bool) {
+	if user.Registered_country == "" {
+		return 0, false
+	}
+	c, ok := u.LookupCountry(user.Registered_country)
+	if !ok {
+		m.unknownCountries.Add(1)
+		countryMisses.Inc()
+		if m.RejectUnknownCountries {
+			m.deadLetter.Add(user.Source, user.RowNum, user.Raw, fmt.Errorf("unknown country %q", user.Registered_country))
+		}
+		return 0, false
+	}
+	user.Registered_country = c.Alpha2
+	return c.Numeric, true
+}
+
+// publishCountries stores the name and codes of every country as attributes
+// of its row in the country frame, so query tools can translate rows back
+// to countries.
+func (m *Main) publishCountries() error {
+	var pql bytes.Buffer
+	for _, c := range u.Countries {
+		fmt.Fprintf(&pql, "SetRowAttrs(frame=%q, rowID=%d, name=%q, alpha2=%q, alpha3=%q)\n", "country", c.Numeric, c.Name, c.Alpha2, c.Alpha3)
+	}
+	if _, err := m.client.Query(m.index.RawQuery(pql.String()), nil); err != nil {
+		return fmt.Errorf("Publishing country table: %v", err)
+	}
+	log.Printf("Published %d countries to the country frame", len(u.Countries))
+	return nil
+}
+
+// connectPilosa sets up the Pilosa client used for queries made outside
+// the indexer.
+func (m *Main) connectPilosa() error {
+	var err error
+	if m.client, err = gopilosa.NewClientFromAddresses(m.Hosts, nil); err != nil {
+		return fmt.Errorf("Connecting to Pilosa: %v", err)
+	}
+	m.index, err = gopilosa.NewIndex(m.IndexName, nil)
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DeadLetter records input lines which could not be loaded, together with
+// the object and line they came from and the reason they were rejected.
+// Records are written as newline delimited JSON to a local file, or to a
+// temporary file which is uploaded under an S3 prefix on Close. With no
+// destination the records are only logged.
+type DeadLetter struct {
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	svc    *s3.S3
+	bucket string
+	key    string
+	count  int64
+}
+
+type deadRecord struct {
+	Key   string `json:"key"`
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+	Line  string `json:"line"`
+}
+
+// NewDeadLetter returns a DeadLetter writing to dest, which is either a
+// local file path or an s3://bucket/prefix URL. svc is only used for S3.
+func NewDeadLetter(dest string, svc *s3.S3) (*DeadLetter, error) {
+	d := &DeadLetter{}
+	if dest == "" {
+		return d, nil
+	}
+
+	var err error
+	if bucket, prefix, ok := parseS3URL(dest); ok {
+		d.svc = svc
+		d.bucket = bucket
+		d.key = path.Join(prefix, fmt.Sprintf("deadletter-%s.json", time.Now().UTC().Format("20060102T150405")))
+		d.file, err = ioutil.TempFile("", "deadletter")
+	} else {
+		d.file, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Opening dead letter output: %v", err)
+	}
+	d.w = bufio.NewWriter(d.file)
+	return d, nil
+}
+
+// Add records line number row of the object named key as rejected because
+// of cause, and returns the number of lines rejected so far.
+func (d *DeadLetter) Add(key string, row int, line []byte, cause error) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.count++
+	if d.w == nil {
+		log.Printf("Rejected %s line %d: %v", key, row, cause)
+		return d.count
+	}
+	b, err := json.Marshal(deadRecord{Key: key, Row: row, Error: cause.Error(), Line: string(line)})
+	if err != nil {
+		log.Printf("Encoding dead letter for %s line %d: %v", key, row, err)
+		return d.count
+	}
+	d.w.Write(b)
+	d.w.WriteByte('\n')
+	return d.count
+}
+
+// Count returns the number of lines rejected so far.
+func (d *DeadLetter) Count() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+// Close flushes the dead letter output, uploading it when it is bound for S3.
+func (d *DeadLetter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.w == nil {
+		return nil
+	}
+	if err := d.w.Flush(); err != nil {
+		return fmt.Errorf("Writing dead letter output: %v", err)
+	}
+	if d.svc == nil {
+		return d.file.Close()
+	}
+
+	defer os.Remove(d.file.Name())
+	defer d.file.Close()
+	if d.count == 0 {
+		return nil
+	}
+	if _, err := d.file.Seek(0, 0); err != nil {
+		return err
+	}
+	_, err := d.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.key),
+		Body:   d.file,
+	})
+	if err != nil {
+		return fmt.Errorf("Uploading dead letter output to s3://%s/%s: %v", d.bucket, d.key, err)
+	}
+	log.Printf("Uploaded %d rejected lines to s3://%s/%s", d.count, d.bucket, d.key)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats understood by decompress.
+const (
+	encodingNone  = ""
+	encodingGzip  = "gzip"
+	encodingZstd  = "zstd"
+	encodingBzip2 = "bzip2"
+)
+
+var (
+	magicGzip  = []byte{0x1f, 0x8b}
+	magicZstd  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicBzip2 = []byte("BZh")
+)
+
+// encodingOf picks the compression format of obj from its extension,
+// falling back to its Content-Encoding.
+func encodingOf(obj *Object) string {
+	switch path.Ext(obj.Key) {
+	case ".gz", ".gzip":
+		return encodingGzip
+	case ".zst", ".zstd":
+		return encodingZstd
+	case ".bz2":
+		return encodingBzip2
+	}
+	switch strings.ToLower(obj.Encoding) {
+	case "gzip", "x-gzip":
+		return encodingGzip
+	case "zstd":
+		return encodingZstd
+	case "bzip2", "x-bzip2":
+		return encodingBzip2
+	}
+	return encodingNone
+}
+
+// sniffEncoding picks the compression format from the magic bytes at the
+// start of r.
+func sniffEncoding(r *bufio.Reader) string {
+	head, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(head, magicGzip):
+		return encodingGzip
+	case bytes.HasPrefix(head, magicZstd):
+		return encodingZstd
+	case bytes.HasPrefix(head, magicBzip2):
+		return encodingBzip2
+	}
+	return encodingNone
+}
+
+// decompress returns a reader over the uncompressed contents of obj, whose
+// raw bytes are read from r.
+func decompress(obj *Object, r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	enc := encodingOf(obj)
+	if enc == encodingNone {
+		enc = sniffEncoding(br)
+	}
+
+	switch enc {
+	case encodingGzip:
+		return gzip.NewReader(br)
+	case encodingZstd:
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case encodingBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *Counter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(n)
+	return n, err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/pilosa/pdk"
+)
+
+// frameCounts tallies what a dry run would have sent to a frame.
+type frameCounts struct {
+	bits   int64
+	values int64
+}
+
+// recordingIndexer is an Indexer for dry runs, which counts the bits and
+// values sent to each frame instead of importing them.
+type recordingIndexer struct {
+	specs map[string]pdk.FrameSpec
+
+	mu     sync.Mutex
+	frames map[string]*frameCounts
+}
+
+func newRecordingIndexer(frames []pdk.FrameSpec) *recordingIndexer {
+	r := &recordingIndexer{
+		specs:  make(map[string]pdk.FrameSpec, len(frames)),
+		frames: make(map[string]*frameCounts),
+	}
+	for _, spec := range frames {
+		r.specs[spec.Name] = spec
+	}
+	return r
+}
+
+func (r *recordingIndexer) counts(frame string) *frameCounts {
+	c, ok := r.frames[frame]
+	if !ok {
+		c = &frameCounts{}
+		r.frames[frame] = c
+	}
+	return c
+}
+
+func (r *recordingIndexer) AddBit(frame string, col uint64, row uint64) {
+	r.mu.Lock()
+	r.counts(frame).bits++
+	r.mu.Unlock()
+}
+
+func (r *recordingIndexer) AddValue(frame, field string, col uint64, val int64) {
+	r.mu.Lock()
+	r.counts(frame).values++
+	r.mu.Unlock()
+}
+
+func (r *recordingIndexer) Close() error { return nil }
+
+// Report writes the counts of each frame, with the values found out of
+// range before reaching the indexer, marking frames missing from the
+// schema, which Pilosa would reject.
+func (r *recordingIndexer) Report(w io.Writer, ranges *Ranges) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.frames))
+	for name := range r.frames {
+		names = append(names, name)
+	}
+	// Frames whose values were all dropped never reached the indexer.
+	for name := range r.specs {
+		if _, ok := r.frames[name]; !ok && ranges.Count(name) > 0 {
+			names = append(names, name)
+			r.frames[name] = &frameCounts{}
+		}
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FRAME\tBITS\tVALUES\tOUT OF RANGE\t")
+	for _, name := range names {
+		c := r.frames[name]
+		note := ""
+		if _, ok := r.specs[name]; !ok {
+			note = "not in schema"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", name, c.bits, c.values, ranges.Count(name), note)
+	}
+	return tw.Flush()
+}
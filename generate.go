@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	u "github.com/travisturner/pilosa-loader/user"
+)
+
+var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+// Generator produces random users from its own source and profile, so
+// that the same seed and profile always generate the same users.
+type Generator struct {
+	rand    *rand.Rand
+	profile *Profile
+	zipfs   map[zipfKey]*rand.Zipf
+	// shard and seq make each generated swid unique.
+	shard int
+	seq   uint64
+	// stats, if set, tallies the generated users.
+	stats *statsIndexer
+}
+
+// NewGenerator returns a Generator seeded with seed, drawing users from
+// the compiled profile p, see LoadProfile. Generators given different
+// shards never generate the same swid.
+func NewGenerator(seed int64, shard int, p *Profile) *Generator {
+	return &Generator{
+		rand:    rand.New(rand.NewSource(seed)),
+		profile: p,
+		zipfs:   make(map[zipfKey]*rand.Zipf),
+		shard:   shard,
+	}
+}
+
+func (g *Generator) randString(n int) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = letterRunes[g.rand.Intn(len(letterRunes))]
+	}
+	return string(b)
+}
+
+// swid returns the next swid: random letters, followed by the shard and
+// sequence number which keep it unique.
+func (g *Generator) swid() string {
+	g.seq++
+	return fmt.Sprintf("%s-%04x-%08x", g.randString(8), g.shard, g.seq)
+}
+
+func (g *Generator) randBool(p float64) bool {
+	return g.rand.Float64() < p
+}
+
+// randInt draws the integer field name from its profile distribution.
+func (g *Generator) randInt(name string) int {
+	return g.randDist(g.profile.Ints[name])
+}
+
+// randFlags draws the boolean fields, drawing each flag before the flags
+// given on it.
+func (g *Generator) randFlags() map[string]bool {
+	flags := make(map[string]bool, len(flagOrder))
+	for _, conditional := range []bool{false, true} {
+		for _, name := range flagOrder {
+			f := g.profile.Flags[name]
+			if (f.Given != "") != conditional {
+				continue
+			}
+			p := f.P
+			if conditional && flags[f.Given] {
+				p = f.PGiven
+			}
+			flags[name] = g.randBool(p)
+		}
+	}
+	return flags
+}
+
+var (
+	leagues = []int32{10, 46, 41, 23, 28, 90, 600}
+	teamCnt = []int{50, 50, 5000, 5000, 50, 50, 5000}
+	buckets = []string{"High", "Medium", "Low"}
+)
+
+func (g *Generator) randFav(f *Favorites) u.Favorite {
+	// choose a league, then a team by popularity
+	league := f.leagues.pick(g.rand)
+	leg, _ := strconv.ParseInt(league, 10, 32)
+	teams := teamCount(league)
+	var tem int32
+	if f.TeamSkew == 0 {
+		tem = int32(g.rand.Intn(teams))
+	} else {
+		tem = int32(g.zipf(f.TeamSkew, uint64(teams-1)).Uint64())
+	}
+
+	return u.Favorite{
+		League_id: int32(leg),
+		Sport_id:  int32(leg),
+		Team_id:   tem,
+		Bucket:    f.buckets.pick(g.rand),
+	}
+}
+
+func (g *Generator) randFavs(f *Favorites) []u.Favorite {
+	n, _ := strconv.Atoi(f.counts.pick(g.rand))
+	favs := make([]u.Favorite, n)
+	for ii := range favs {
+		favs[ii] = g.randFav(f)
+	}
+	return favs
+}
+
+// RandomUser returns the next random user.
+func (g *Generator) RandomUser() *u.User {
+	p := g.profile
+	typ := ""
+	if g.randBool(p.Registered) {
+		typ = "registered"
+	}
+	flags := g.randFlags()
+	return &u.User{
+		Swid:   g.swid(),
+		Type:   typ,
+		Gender: p.gender.pick(g.rand),
+		Age:    g.randInt("age"),
+		//Registered_country // NOT USED
+		Registered_dma_id:      fmt.Sprintf("%d", g.randInt("registered_dma_id")),
+		Registered_postal_code: fmt.Sprintf("%d", g.randInt("registered_postal_code")),
+		Is_league_manager:      flags["is_league_manager"],
+		Plays_fantasy:          flags["plays_fantasy"],
+		Stated_teams_favorites: g.randFavs(p.Stated),
+		PageViews:              g.randInt("page_views"),
+		TimeSpent:              g.randInt("time_spent"),
+		//VideoStarts // NOT USED
+		VideoCompletes:   g.randInt("video_completes"),
+		Visits:           g.randInt("visits"),
+		Hits:             g.randInt("hits"),
+		HasFavorites:     flags["has_favorites"],
+		HasNotifications: flags["has_notifications"],
+		HasAutostart:     flags["has_autostart"],
+		IsInsider:        flags["is_insider"],
+
+		//Latitude // NOT USED
+		//Longitude// NOT USED
+		//IsRegistered // NOT USED
+		Derived_teams: g.randFavs(p.Derived),
+	}
+}
+
+// Generate writes n random users as newline delimited JSON. With no out
+// they are printed to stdout; otherwise they are split across shards files
+// written in parallel to out, a local directory or an s3://bucket/prefix
+// URL, and optionally gzipped. Shard i is generated from seed+i, so the
+// output depends only on the profile, seed, record count and shard count.
+// If statsPath is set, a summary of what loading the users with the
+// OutOfRange policy sets in Pilosa is written there, see Stats.
+func (m *Main) Generate(p *Profile, n, shards int, out string, gz bool, seed int64, statsPath string) error {
+	ranges, err := NewRanges(u.Frames, m.OutOfRange)
+	if err != nil {
+		return err
+	}
+	var gens []*Generator
+	for shard := 0; shard < shards; shard++ {
+		g := NewGenerator(seed+int64(shard), shard, p)
+		if statsPath != "" {
+			g.stats = newStatsIndexer(m, ranges)
+		}
+		gens = append(gens, g)
+	}
+
+	if err := m.generate(gens, n, out, gz); err != nil {
+		return err
+	}
+	if statsPath == "" {
+		return nil
+	}
+	stats := NewStats()
+	for _, g := range gens {
+		stats.Merge(g.stats.stats)
+	}
+	if err := stats.Save(statsPath); err != nil {
+		return err
+	}
+	log.Printf("Wrote stats of %d users to %s", stats.Records, statsPath)
+	return nil
+}
+
+// generate writes n users split across the generators, one shard each.
+func (m *Main) generate(gens []*Generator, n int, out string, gz bool) error {
+	if out == "" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := writeUsers(w, gens[0], n); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	bucket, prefix, toS3 := parseS3URL(out)
+	var uploader *s3manager.Uploader
+	if toS3 {
+		svc, err := m.s3Service()
+		if err != nil {
+			return err
+		}
+		uploader = s3manager.NewUploaderWithClient(svc)
+	} else if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+
+	shards := len(gens)
+	errs := make(chan error, shards)
+	var wg sync.WaitGroup
+	for shard, g := range gens {
+		// Spread the remainder over the first shards.
+		count := n / shards
+		if shard < n%shards {
+			count++
+		}
+		name := fmt.Sprintf("part-%05d.json", shard)
+		if gz {
+			name += ".gz"
+		}
+
+		wg.Add(1)
+		go func(name string, count int, g *Generator) {
+			defer wg.Done()
+			var err error
+			if toS3 {
+				err = generateS3(uploader, bucket, path.Join(prefix, name), g, count, gz)
+			} else {
+				err = generateFile(filepath.Join(out, name), g, count, gz)
+			}
+			if err != nil {
+				errs <- fmt.Errorf("Generating %s: %v", name, err)
+			}
+		}(name, count, g)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	log.Printf("Generated %d users in %d files under %s", n, shards, out)
+	return nil
+}
+
+// generateFile writes n random users to the file at path.
+func generateFile(path string, g *Generator, n int, gz bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeShard(f, g, n, gz); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// generateS3 streams n random users to key in bucket. The uploader sends
+// them as a multipart upload, so shards are not limited to the 5GB of a
+// single put.
+func generateS3(uploader *s3manager.Uploader, bucket, key string, g *Generator, n int, gz bool) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeShard(pw, g, n, gz))
+	}()
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   pr,
+	})
+	// Unblock the writer if the upload failed part way.
+	pr.CloseWithError(err)
+	return err
+}
+
+// writeShard writes n random users to w, gzipped if gz is set.
+func writeShard(w io.Writer, g *Generator, n int, gz bool) error {
+	bw := bufio.NewWriter(w)
+	if !gz {
+		if err := writeUsers(bw, g, n); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	zw := gzip.NewWriter(bw)
+	if err := writeUsers(zw, g, n); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeUsers writes n random users from g to w, one JSON object per line.
+func writeUsers(w io.Writer, g *Generator, n int) error {
+	enc := json.NewEncoder(w)
+	for ii := 0; ii < n; ii++ {
+		user := g.RandomUser()
+		if err := enc.Encode(user); err != nil {
+			return err
+		}
+		if g.stats != nil {
+			g.stats.addUser(user)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Indexer is the sink users are indexed into: the part of pdk.Indexer the
+// loader uses. Loads send to Pilosa through pdk, dry runs to a
+// recordingIndexer, -gen -stats to a statsIndexer, and MemoryIndexer keeps
+// everything in memory.
+type Indexer interface {
+	AddBit(frame string, col uint64, row uint64)
+	AddValue(frame, field string, col uint64, val int64)
+	Close() error
+}
+
+// MemoryIndexer is an Indexer holding bitmaps and field values in memory,
+// so what indexing sets can be inspected without a Pilosa server. Like
+// Pilosa, setting a bit twice has no further effect and a value replaces
+// the previous value of the column.
+type MemoryIndexer struct {
+	mu     sync.Mutex
+	bits   map[string]map[uint64]map[uint64]struct{}
+	values map[string]map[string]map[uint64]int64
+}
+
+// NewMemoryIndexer returns an empty MemoryIndexer.
+func NewMemoryIndexer() *MemoryIndexer {
+	return &MemoryIndexer{
+		bits:   make(map[string]map[uint64]map[uint64]struct{}),
+		values: make(map[string]map[string]map[uint64]int64),
+	}
+}
+
+func (i *MemoryIndexer) AddBit(frame string, col uint64, row uint64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	rows, ok := i.bits[frame]
+	if !ok {
+		rows = make(map[uint64]map[uint64]struct{})
+		i.bits[frame] = rows
+	}
+	cols, ok := rows[row]
+	if !ok {
+		cols = make(map[uint64]struct{})
+		rows[row] = cols
+	}
+	cols[col] = struct{}{}
+}
+
+func (i *MemoryIndexer) AddValue(frame, field string, col uint64, val int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	fields, ok := i.values[frame]
+	if !ok {
+		fields = make(map[string]map[uint64]int64)
+		i.values[frame] = fields
+	}
+	vals, ok := fields[field]
+	if !ok {
+		vals = make(map[uint64]int64)
+		fields[field] = vals
+	}
+	vals[col] = val
+}
+
+func (i *MemoryIndexer) Close() error { return nil }
+
+// Frames returns the names of the frames with bits or values set.
+func (i *MemoryIndexer) Frames() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var names []string
+	for name := range i.bits {
+		names = append(names, name)
+	}
+	for name := range i.values {
+		if _, ok := i.bits[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Bit reports whether the bit at row and col of frame is set.
+func (i *MemoryIndexer) Bit(frame string, row, col uint64) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	_, ok := i.bits[frame][row][col]
+	return ok
+}
+
+// Rows returns the rows of frame with bits set in col, in order.
+func (i *MemoryIndexer) Rows(frame string, col uint64) []uint64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var rows []uint64
+	for row, cols := range i.bits[frame] {
+		if _, ok := cols[col]; ok {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(a, b int) bool { return rows[a] < rows[b] })
+	return rows
+}
+
+// Columns returns the columns set in row of frame, in order.
+func (i *MemoryIndexer) Columns(frame string, row uint64) []uint64 {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	cols := make([]uint64, 0, len(i.bits[frame][row]))
+	for col := range i.bits[frame][row] {
+		cols = append(cols, col)
+	}
+	sort.Slice(cols, func(a, b int) bool { return cols[a] < cols[b] })
+	return cols
+}
+
+// Value returns the value of field in frame for col, if set.
+func (i *MemoryIndexer) Value(frame, field string, col uint64) (int64, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	v, ok := i.values[frame][field][col]
+	return v, ok
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// keyServerMain implements the keyserver subcommand, which serves a key
+// store over HTTP so that loaders on several hosts, or several loaders on
+// one host, allocate columns from the same key store at the same time.
+// Loaders use it by passing its URL as -keys.
+func keyServerMain(args []string) {
+	fs := flag.NewFlagSet("keyserver", flag.ExitOnError)
+	keys := fs.String("keys", "keys.db", "Path of the key store mapping swids to column IDs.")
+	bind := fs.String("bind", ":10102", "Address to serve the key store on.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s keyserver [OPTIONS]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	t, err := OpenTranslator(*keys, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Addr: *bind, Handler: newKeyHandler(t)}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Printf("Interrupted, closing key store %s", *keys)
+		srv.Close()
+	}()
+
+	log.Printf("Serving key store %s on %s", *keys, *bind)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	if err := t.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// columnsResponse is the reply to a POST of swids to /columns.
+type columnsResponse struct {
+	Columns []uint64 `json:"columns"`
+	// Collisions are those found among the swids allocated by this
+	// request.
+	Collisions []Collision `json:"collisions,omitempty"`
+}
+
+// newKeyHandler serves t. POST /columns takes a JSON array of swids and
+// returns their column IDs, allocating new ones as needed, and GET
+// /swid/<column> returns the swid of a column as text.
+func newKeyHandler(t *Translator) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/columns", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST a JSON array of swids", http.StatusMethodNotAllowed)
+			return
+		}
+		var swids []string
+		if err := json.NewDecoder(r.Body).Decode(&swids); err != nil {
+			http.Error(w, fmt.Sprintf("Decoding swids: %v", err), http.StatusBadRequest)
+			return
+		}
+		ids, collisions, err := t.columnIDs(swids)
+		if err != nil {
+			log.Printf("Allocating columns: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, c := range collisions {
+			log.Printf("Swid hash collision %d: %s %s", c.Hash, c.Swids[0], c.Swids[1])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(columnsResponse{Columns: ids, Collisions: collisions})
+	})
+	mux.HandleFunc("/swid/", func(w http.ResponseWriter, r *http.Request) {
+		col, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/swid/"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad column ID", http.StatusBadRequest)
+			return
+		}
+		swid, ok, err := t.Swid(col)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(swid))
+	})
+	return mux
+}
+
+// KeyClient is a KeyStore served by a key server. Column allocations are
+// committed by the server before it replies.
+type KeyClient struct {
+	url    string
+	client *http.Client
+
+	mu         sync.Mutex
+	collisions []Collision
+}
+
+// NewKeyClient returns a KeyClient for the key server at url.
+func NewKeyClient(url string) *KeyClient {
+	return &KeyClient{
+		url:    strings.TrimRight(url, "/"),
+		client: &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (c *KeyClient) ColumnIDs(swids []string) ([]uint64, error) {
+	body, err := json.Marshal(swids)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Post(c.url+"/columns", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Key server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Key server: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var cr columnsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+		return nil, fmt.Errorf("Key server: decoding columns: %v", err)
+	}
+	if len(cr.Columns) != len(swids) {
+		return nil, fmt.Errorf("Key server: %d columns returned for %d swids", len(cr.Columns), len(swids))
+	}
+	if len(cr.Collisions) > 0 {
+		c.mu.Lock()
+		c.collisions = append(c.collisions, cr.Collisions...)
+		c.mu.Unlock()
+	}
+	return cr.Columns, nil
+}
+
+func (c *KeyClient) Swid(columnID uint64) (string, bool, error) {
+	resp, err := c.client.Get(fmt.Sprintf("%s/swid/%d", c.url, columnID))
+	if err != nil {
+		return "", false, fmt.Errorf("Key server: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, fmt.Errorf("Key server: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return string(body), true, nil
+	case http.StatusNotFound:
+		return "", false, nil
+	}
+	return "", false, fmt.Errorf("Key server: %s: %s", resp.Status, bytes.TrimSpace(body))
+}
+
+// Collisions returns the swid hash collisions the server found among the
+// swids allocated through c.
+func (c *KeyClient) Collisions() []Collision {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Collision(nil), c.collisions...)
+}
+
+func (c *KeyClient) Close() error { return nil }
@@ -2,21 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
+	"math"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	hash "github.com/aviddiviner/go-murmur"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	gopilosa "github.com/pilosa/go-pilosa"
 	"github.com/pilosa/pdk"
@@ -24,226 +24,303 @@ import (
 )
 
 type Main struct {
-	BasePath   string
-	Hosts      []string
-	IndexName  string
-	BufferSize uint
-	Bucket     string
-	Prefix     string
-	AWSRegion  string
-	S3svc      *s3.S3
-	S3files    []*s3.Object
-	totalBytes int64
-	bytesLock  sync.RWMutex
-	totalRecs  *Counter
-	indexer    pdk.Indexer
-	nexter     *pdk.Nexter
-	index      *gopilosa.Index
-	client     *gopilosa.Client
+	Hosts                  []string
+	IndexName              string
+	BufferSize             uint
+	Bucket                 string
+	Prefix                 string
+	LocalPaths             []string
+	AWSRegion              string
+	S3Endpoint             string
+	S3PathStyle            bool
+	S3DisableSSL           bool
+	AWSAccessKey           string
+	AWSSecretKey           string
+	AWSProfile             string
+	S3svc                  *s3.S3
+	Source                 Source
+	totalBytes             int64
+	bytesLock              sync.RWMutex
+	totalRecs              *Counter
+	listedObjs             *Counter
+	listedSize             *Counter
+	compressedBytes        *Counter
+	geoLookups             *Counter
+	geoMisses              *Counter
+	unknownCountries       *Counter
+	unknownLeagues         *Counter
+	unindexed              *Counter
+	malformed              *Counter
+	stop                   chan struct{}
+	stopOnce               sync.Once
+	abortErr               error
+	abortOnce              sync.Once
+	DeadLetterPath         string
+	MaxErrors              int64
+	deadLetter             *DeadLetter
+	MappingPath            string
+	mapping                *Mapping
+	Readers                int
+	Writers                int
+	files                  chan *Object
+	Retries                int
+	RetryDelay             time.Duration
+	users                  chan u.User
+	KeysPath               string
+	GeoCodesPath           string
+	CountriesPath          string
+	RejectUnknownCountries bool
+	OutOfRange             string
+	PointerPath            string
+	StatsPath              string
+	BaseIndex              string
+	Keep                   int
+	Overwrite              bool
+	ranges                 *Ranges
+	CollisionsPath         string
+	CheckpointPath         string
+	Resume                 bool
+	DryRun                 bool
+	indexer                Indexer
+	recorder               *recordingIndexer
+	translator             KeyStore
+	checkpoint             *Checkpoint
+	index                  *gopilosa.Index
+	client                 *gopilosa.Client
 }
 
 // NewMain allocates a new pointer to Main struct with empty record counter
 func NewMain() *Main {
 	m := &Main{
-		nexter:    pdk.NewNexter(),
-		totalRecs: &Counter{},
+		totalRecs:        &Counter{},
+		listedObjs:       &Counter{},
+		listedSize:       &Counter{},
+		compressedBytes:  &Counter{},
+		geoLookups:       &Counter{},
+		geoMisses:        &Counter{},
+		unknownCountries: &Counter{},
+		unknownLeagues:   &Counter{},
+		unindexed:        &Counter{},
+		malformed:        &Counter{},
+		stop:             make(chan struct{}),
 	}
 	return m
 }
 
-var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-
-func randString(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
-	}
-	return string(b)
-}
-
-func randBool(n int) bool {
-	x := rand.Intn(100)
-	return x < n
-}
-
-func randInt(from, to int) int {
-	return from + rand.Intn(to-from)
-}
-
-var (
-	leagues = []int32{10, 46, 41, 23, 28, 90, 600}
-	teamCnt = []int{50, 50, 5000, 5000, 50, 50, 5000}
-	buckets = []string{"High", "Medium", "Low"}
-)
-
-func randFav() u.Favorite {
-	// choose a random leage, then team
-	r := rand.Intn(len(leagues))
-	leg := leagues[r]
-	tem := int32(rand.Intn(teamCnt[r]))
-	buc := buckets[rand.Intn(3)]
-
-	return u.Favorite{
-		League_id: leg,
-		Sport_id:  leg,
-		Team_id:   tem,
-		Bucket:    buc,
-	}
-}
-
-func randFavs() []u.Favorite {
-	opts := []int{0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 2, 2, 3}
-	rnd := rand.Intn(len(opts))
-	favs := make([]u.Favorite, opts[rnd])
-	for ii := range favs {
-		favs[ii] = randFav()
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "lookup" {
+		lookupMain(os.Args[2:])
+		return
 	}
-	return favs
-}
-
-func RandomUser() *u.User {
-	typ := ""
-	if randBool(10) {
-		typ = "registered"
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyMain(os.Args[2:])
+		return
 	}
-	gender := "U"
-	if randBool(80) {
-		if randBool(50) {
-			gender = "M"
-		} else {
-			gender = "F"
-		}
-	}
-	return &u.User{
-		Swid:   randString(8),
-		Type:   typ,
-		Gender: gender,
-		Age:    randInt(10, 100),
-		//Registered_country // NOT USED
-		Registered_dma_id:      fmt.Sprintf("%d", randInt(0, 10000)),
-		Registered_postal_code: fmt.Sprintf("%d", randInt(10000, 99999)),
-		Is_league_manager:      randBool(5),
-		Plays_fantasy:          randBool(25),
-		Stated_teams_favorites: randFavs(),
-		PageViews:              randInt(0, 65535),
-		TimeSpent:              randInt(0, 10000000),
-		//VideoStarts // NOT USED
-		VideoCompletes:   randInt(0, 65535),
-		Visits:           randInt(0, 65535),
-		Hits:             randInt(0, 65535),
-		HasFavorites:     randBool(20),
-		HasNotifications: randBool(10),
-		HasAutostart:     randBool(20),
-		IsInsider:        randBool(20),
-
-		//Latitude // NOT USED
-		//Longitude// NOT USED
-		//IsRegistered // NOT USED
-		Derived_teams: randFavs(),
+	if len(os.Args) > 1 && os.Args[1] == "keyserver" {
+		keyServerMain(os.Args[2:])
+		return
 	}
-}
 
-func main() {
 	indexName := flag.String("index", "user360", "Index name.")
 	hosts := flag.String("hosts", "localhost:10101", "Pilosa server hosts as comma separated list.")
 	bufSize := flag.Int("bufSize", 1000000, "Import buffer size.")
-	region := flag.String("region", "us-east-1", "AWS Region.")
-	hash := flag.String("hash", "", "Print hash value for a string and exit.")
+	s3opts := addS3Flags(flag.CommandLine)
+	hash := flag.String("hash", "", "Print the swid hash value stored for a string and exit.")
 	gen := flag.Bool("gen", false, "Generate Users and exit.")
 	records := flag.Int("records", 10, "Number of records to generate.")
+	out := flag.String("out", "", "Directory or s3://bucket/prefix to write generated records to, instead of stdout.")
+	shards := flag.Int("shards", 1, "Number of files to split generated records across.")
+	gzipOut := flag.Bool("gzip", false, "Gzip generated files.")
+	profilePath := flag.String("genProfile", "", "JSON file of distributions to generate user fields from, see profile.example.json.")
+	stats := flag.String("stats", "", "With -gen, file to write a JSON summary of generated users to. With -pointer, a summary written by -gen -stats to verify the new version against, instead of reading the source again.")
+	seed := flag.Int64("seed", 0, "Seed for generating users, so runs can be reproduced. Chosen from the clock when 0.")
+	keys := flag.String("keys", "keys.db", "Path of the key store mapping swids to column IDs, or the http:// URL of a key server shared by several loaders.")
+	checkpoint := flag.String("checkpoint", "loader.checkpoint", "Path of the checkpoint file recording loaded files, empty to disable.")
+	resume := flag.Bool("resume", false, "Resume from the checkpoint file, skipping files already loaded.")
+	deadLetter := flag.String("deadLetter", "", "Local file or s3://bucket/prefix receiving malformed lines, logged when empty.")
+	maxErrors := flag.Int64("maxErrors", 0, "Abort after this many malformed lines, 0 for no limit.")
+	mapping := flag.String("mapping", "", "JSON file declaring how record fields map to frames, replacing the built in mapping.")
+	readers := flag.Int("readers", 10, "Number of files read concurrently.")
+	writers := flag.Int("writers", 5, "Number of goroutines indexing records.")
+	retries := flag.Int("retries", 5, "Number of times to retry reading a file after an error.")
+	retryDelay := flag.Duration("retryDelay", time.Second, "Initial delay between retries, doubled on each attempt.")
+	metrics := flag.String("metrics", "", "Address to serve Prometheus metrics on, e.g. :9090, disabled when empty.")
+	collisions := flag.String("collisions", "", "File to write a report of swids sharing a swid hash to.")
+	geocodes := flag.String("geocodes", "", "Postal code gazetteer in GeoNames format, used to fill the latitude and longitude frames.")
+	countries := flag.String("countries", "", "CSV country table (alpha2,alpha3,numeric,name) replacing the built in ISO 3166 table.")
+	outOfRange := flag.String("outOfRange", RangeDrop, "What to do with values outside the range of their field: clamp, drop, or deadletter to drop them and send the record to the dead letter output.")
+	rejectCountries := flag.Bool("rejectUnknownCountries", false, "Send users with an unknown registered country to the dead letter output, as well as indexing them.")
+	pointer := flag.String("pointer", "", "Local file or s3://bucket/key naming the live index. When set, loads go into a new version of the index, which is verified against the source before the pointer is switched to it.")
+	version := flag.String("version", time.Now().UTC().Format(versionFormat), "Version of the index loaded with -pointer, named <index>_<version>. Required with -resume, as the default is today's date.")
+	keep := flag.Int("keep", 3, "Number of index versions kept with -pointer, besides the version the pointer named before.")
+	overwrite := flag.Bool("overwrite", false, "Load with -pointer into an index version which already exists, even the one the pointer names.")
+	dryRun := flag.Bool("dry-run", false, "Read and index the source without writing to Pilosa or the key store, and report what would be loaded.")
+	local := flag.Bool("local", false, "Load local files, directories or glob patterns given as arguments instead of S3.")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] <S3Bucket> <S3Prefix>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [OPTIONS] -local <path|dir|glob>...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s lookup [OPTIONS]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s verify [OPTIONS]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s keyserver [OPTIONS]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
 	if *hash != "" {
-		fmt.Printf("Hash value is %d.\n", get64BitHash(*hash))
+		fmt.Printf("Hash value is %d.\n", swidHash(*hash))
 		os.Exit(0)
 	}
 
 	if *gen {
-		cnt := *records
-
-		for ii := 0; ii < cnt; ii++ {
-			u := RandomUser()
-			//fmt.Printf("u: %v\n", u)
-			b, err := json.Marshal(u)
-			if err != nil {
-				log.Fatal("json marshal")
-				os.Exit(0)
-			}
-			fmt.Println(string(b))
+		if *shards < 1 {
+			log.Fatal("At least one shard is required.")
+		}
+		if *out == "" && (*shards > 1 || *gzipOut) {
+			log.Fatal("-shards and -gzip need -out, generated records are otherwise printed to stdout.")
+		}
+		profile, err := LoadProfile(*profilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		log.Printf("Generating users with seed %d", *seed)
+		main := NewMain()
+		s3opts.apply(main)
+		main.OutOfRange = *outOfRange
+		if err := main.Generate(profile, *records, *shards, *out, *gzipOut, *seed, *stats); err != nil {
+			log.Fatal(err)
 		}
-
 		os.Exit(0)
 	}
 
-	if len(flag.Args()) < 2 {
+	if *readers < 1 || *writers < 1 {
+		flag.Usage()
+		log.Fatal("At least one reader and one writer are required.")
+	}
+
+	if *local && len(flag.Args()) < 1 {
+		flag.Usage()
+		log.Fatal("At least one local path must be specified.")
+	} else if !*local && len(flag.Args()) < 2 {
 		flag.Usage()
 		log.Fatal("S3 Bucket and Prefix must be specified.")
 	}
 
+	if *dryRun && *resume {
+		log.Fatal("-resume cannot be used with -dry-run.")
+	}
+
 	main := NewMain()
 	main.Hosts = strings.Split(*hosts, ",")
 	main.IndexName = *indexName
 	main.BufferSize = uint(*bufSize)
-	main.AWSRegion = *region
+	s3opts.apply(main)
+	main.KeysPath = *keys
+	main.GeoCodesPath = *geocodes
+	main.CountriesPath = *countries
+	main.RejectUnknownCountries = *rejectCountries
+	main.OutOfRange = *outOfRange
+	main.CollisionsPath = *collisions
+	main.CheckpointPath = *checkpoint
+	main.Resume = *resume
+	main.DeadLetterPath = *deadLetter
+	main.MaxErrors = *maxErrors
+	main.MappingPath = *mapping
+	main.Readers = *readers
+	main.Writers = *writers
+	main.Retries = *retries
+	main.RetryDelay = *retryDelay
+	main.DryRun = *dryRun
+	if *pointer != "" {
+		if *keep < 1 {
+			log.Fatal("At least one index version must be kept.")
+		}
+		if *resume && !flagSet(flag.CommandLine, "version") {
+			log.Fatal("-resume with -pointer requires the -version the interrupted load was started with.")
+		}
+		name, err := versionedIndex(*indexName, *version)
+		if err != nil {
+			log.Fatal(err)
+		}
+		main.PointerPath = *pointer
+		main.StatsPath = *stats
+		main.BaseIndex = *indexName
+		main.IndexName = name
+		main.Keep = *keep
+		main.Overwrite = *overwrite
+	} else if *stats != "" {
+		log.Fatal("-stats is only used with -gen or -pointer.")
+	}
+	if *local {
+		main.LocalPaths = flag.Args()
+	} else {
+		main.Bucket = flag.Args()[0]
+		main.Prefix = flag.Args()[1]
+	}
 
 	fmt.Printf("Pilosa hosts %s.\n", main.Hosts)
 	fmt.Printf("Index name %s.\n", main.IndexName)
+	if main.PointerPath != "" {
+		fmt.Printf("Index pointer %s.\n", main.PointerPath)
+	}
 	fmt.Printf("Buffer size %d.\n", main.BufferSize)
-	fmt.Printf("AWS region %s\n", main.AWSRegion)
+	fmt.Printf("Readers %d, writers %d.\n", main.Readers, main.Writers)
+	if main.AWSRegion != "" {
+		fmt.Printf("AWS region %s\n", main.AWSRegion)
+	}
+	if main.S3Endpoint != "" {
+		fmt.Printf("S3 endpoint %s\n", main.S3Endpoint)
+	}
+	fmt.Printf("Key store %s\n", main.KeysPath)
+	if main.MappingPath != "" {
+		fmt.Printf("Field mapping %s\n", main.MappingPath)
+	}
+	if main.Resume {
+		fmt.Printf("Resuming from checkpoint %s\n", main.CheckpointPath)
+	}
+	if main.DryRun {
+		fmt.Printf("Dry run, nothing will be written to Pilosa.\n")
+	}
 
+	if main.PointerPath != "" && !main.DryRun {
+		if err := main.checkVersion(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if err := main.Init(); err != nil {
 		log.Fatal(err)
 	}
 
-	main.Bucket = flag.Args()[0]
-	main.Prefix = flag.Args()[1]
+	fmt.Printf("Listing files for processing from %s.\n", main.Source)
 
-	main.LoadBucketContents()
+	// Queues are sized so that each stage can keep the next one busy.
+	files := make(chan *Object, 2*main.Readers)
+	users := make(chan u.User, 2000*main.Writers)
+	main.files, main.users = files, users
 
-	fmt.Printf("S3 bucket %s contains %d files for processing.\n", main.Bucket, len(main.S3files))
+	if *metrics != "" {
+		main.serveMetrics(*metrics)
+	}
 
 	ticker := main.printStats()
 
-	s3files := make(chan *s3.Object, 100)
-	users := make(chan u.User, 10000)
-
 	go func() {
-		for _, file := range main.S3files {
-			s3files <- file
+		if err := main.LoadContents(files); err != nil {
+			main.Abort(err)
 		}
-		close(s3files)
-	}()
-
-	c := make(chan os.Signal, 1)
-
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for range c {
-			log.Printf("Interrupted,  Bytes processed: %s", pdk.Bytes(main.BytesProcessed()))
-			os.Exit(0)
+		close(files)
+		if !main.Stopped() {
+			log.Printf("Listed %d files, %s, from %s", main.listedObjs.Get(), pdk.Bytes(main.listedSize.Get()), main.Source)
 		}
 	}()
 
-	var wg sync.WaitGroup
-	for i := 0; i < len(main.S3files); i++ {
-		wg.Add(1)
-		go func() {
-			file, open := <-s3files
-			if open {
-				main.getUsers(file, users)
-				wg.Done()
-			}
-		}()
-	}
+	main.handleSignals()
 
 	var wg2 sync.WaitGroup
-	//for i := 0; i < len(main.S3files); i++ {
-	for i := 0; i < 5; i++ {
+	for i := 0; i < main.Writers; i++ {
 		wg2.Add(1)
 		go func() {
 			main.insertUsers(users)
@@ -251,155 +328,412 @@ func main() {
 		}()
 	}
 
+	var wg sync.WaitGroup
+	for i := 0; i < main.Readers; i++ {
+		wg.Add(1)
+		go func() {
+			for file := range files {
+				main.getUsers(file, users)
+			}
+			wg.Done()
+		}()
+	}
+
 	wg.Wait()
 	close(users)
 	wg2.Wait()
 
 	ticker.Stop()
-	time.Sleep(10 * time.Second)
-	log.Printf("Completed, Last Record: %d, Bytes: %s", main.totalRecs.Get(), pdk.Bytes(main.BytesProcessed()))
+	if main.Stopped() {
+		log.Printf("Flushing indexer, Last Record: %d, Bytes: %s", main.totalRecs.Get(), pdk.Bytes(main.BytesProcessed()))
+		main.Close()
+		if n := main.unindexed.Get(); n > 0 {
+			// The checkpoint counts lines read, so saving it would
+			// skip these users on resume.
+			log.Printf("Stopped, %d users read were not indexed, checkpoint not saved", n)
+		} else {
+			if err := main.checkpoint.Save(); err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Stopped, checkpoint saved to %s", main.CheckpointPath)
+		}
+		if main.abortErr != nil {
+			os.Exit(exitAborted)
+		}
+		os.Exit(exitInterrupted)
+	}
+	if !main.DryRun {
+		time.Sleep(10 * time.Second)
+	}
+	log.Printf("Completed, Last Record: %d, Bytes: %s, Rejected: %d", main.totalRecs.Get(), pdk.Bytes(main.BytesProcessed()), main.deadLetter.Count())
+	if n := main.unknownCountries.Get(); n > 0 {
+		log.Printf("Unknown countries: %d", n)
+	}
+	if n := main.unknownLeagues.Get(); n > 0 {
+		log.Printf("Favorites in unknown leagues: %d", n)
+	}
+	main.ranges.Log()
+	if lookups := main.geoLookups.Get(); lookups > 0 {
+		log.Printf("Geocoded postal codes: %d, Missed: %d (%.1f%%)", lookups, main.geoMisses.Get(), 100*float64(main.geoMisses.Get())/float64(lookups))
+	}
 	main.Close()
+	if err := main.checkpoint.Save(); err != nil {
+		log.Fatal(err)
+	}
+	if main.DryRun {
+		if err := main.recorder.Report(os.Stdout, main.ranges); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if main.PointerPath != "" {
+		if err := main.cutover(); err != nil {
+			if err == errStopped {
+				log.Printf("Interrupted during cutover, leaving %s unchanged", main.PointerPath)
+				os.Exit(exitInterrupted)
+			}
+			if _, ok := err.(*mismatchError); ok {
+				log.Printf("FAIL: %v, leaving %s unchanged", err, main.PointerPath)
+				os.Exit(exitMismatch)
+			}
+			log.Fatal(err)
+		}
+	}
 }
 
-func exitErrorf(msg string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, msg+"\n", args...)
-	os.Exit(1)
+// flagSet reports whether the flag name was given on the command line,
+// rather than left at its default.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-// List S3 objects from AWS bucket based on command line argument of the bucket name
-func (m *Main) LoadBucketContents() {
-	// Use the commented line to restrict the number of files loaded (for local testing)
-	//resp, err := m.S3svc.ListObjects(&s3.ListObjectsInput{Bucket: aws.String(m.Bucket), Prefix: aws.String(m.Prefix),MaxKeys: aws.Int64(10)})
-	resp, err := m.S3svc.ListObjects(&s3.ListObjectsInput{Bucket: aws.String(m.Bucket), Prefix: aws.String(m.Prefix)})
-	if err != nil {
-		exitErrorf("Unable to list items in bucket %q, %v", m.Bucket, err)
+// LoadContents streams the objects available from the configured source
+// into files as they are listed, counting the keys and bytes discovered.
+func (m *Main) LoadContents(files chan<- *Object) error {
+	listed := make(chan *Object)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.Source.List(listed)
+		close(listed)
+	}()
+	for obj := range listed {
+		m.listedObjs.Add(1)
+		objectsListed.Inc()
+		m.listedSize.Add(int(obj.Size))
+		select {
+		case files <- obj:
+		case <-m.stop:
+			// The listing goroutine is left blocked; the process
+			// is about to exit.
+			return nil
+		}
 	}
-	m.S3files = resp.Contents
+	return <-errc
 }
 
-func (m *Main) getUsers(s3object *s3.Object, users chan<- u.User) {
+func (m *Main) getUsers(obj *Object, users chan<- u.User) {
+	if m.Stopped() {
+		return
+	}
+	progress := m.checkpoint.Start(obj.Key)
+	if progress.Done {
+		log.Printf("Skipping %s, already loaded", obj.Key)
+		return
+	}
+	// Lines already read by an earlier run are scanned past, not reloaded.
+	skip := progress.Lines
+	if skip > 0 {
+		log.Printf("Resuming %s after line %d", obj.Key, skip)
+	}
 
-	result, err := m.S3svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(m.Bucket),
-		Key:    aws.String(*s3object.Key),
-	})
+	raw, err := m.openObject(obj)
 	if err != nil {
-		log.Fatal(err)
+		if err != errStopped {
+			objectsFailed.Inc()
+			m.Abort(fmt.Errorf("Reading %s: %v", obj.Key, err))
+		}
+		return
 	}
-	scan := bufio.NewScanner(result.Body)
-	buf := make([]byte, 0, 64*1024)
-	scan.Buffer(buf, 1024*1024)
-	i := 1
-	for scan.Scan() {
-		line := scan.Bytes()
+	defer raw.Close()
+
+	body, err := decompress(obj, &countingReader{r: raw, n: m.compressedBytes})
+	if err != nil {
+		objectsFailed.Inc()
+		m.Abort(fmt.Errorf("Decompressing %s: %v", obj.Key, err))
+		return
+	}
+	defer body.Close()
+
+	r := bufio.NewReaderSize(body, maxLineSize)
+	for i := 1; ; i++ {
+		line, readErr := readLine(r)
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil && readErr != errLineTooLong {
+			if readErr != errStopped {
+				objectsFailed.Inc()
+				m.Abort(fmt.Errorf("Reading %s at line %d: %v", obj.Key, i, readErr))
+			}
+			return
+		}
+		if m.Stopped() {
+			log.Printf("Stopped reading %s at line %d", obj.Key, i-1)
+			return
+		}
+		if int64(i) <= skip {
+			continue
+		}
 		m.AddBytes(len(line))
+		linesRead.Inc()
 		var u u.User
-		json.Unmarshal(line, &u)
-		u.RowNum = i
-		users <- u
-		i++
+		if readErr != nil {
+			err = readErr
+		} else if m.mapping != nil {
+			u.Doc, u.Swid, err = m.mapping.Decode(line)
+		} else {
+			err = json.Unmarshal(line, &u)
+		}
+		if err != nil {
+			m.reject(obj.Key, i, line, err)
+		} else if u.Swid == "" {
+			m.reject(obj.Key, i, line, m.missingSwid())
+		} else {
+			u.RowNum = i
+			u.Source = obj.Key
+			if m.mapping != nil || m.RejectUnknownCountries || m.OutOfRange == RangeDeadLetter {
+				u.Raw = append([]byte(nil), line...)
+			}
+			users <- u
+		}
+		progress.SetLines(int64(i))
 	}
-	if err2 := scan.Err(); err2 != nil {
-		log.Fatal(err2)
+	m.checkpoint.Complete(obj.Key)
+	objectsCompleted.Inc()
+}
+
+// maxLineSize is the longest line read from a source.
+const maxLineSize = 1024 * 1024
+
+var errLineTooLong = fmt.Errorf("line longer than %d bytes", maxLineSize)
+
+// readLine returns the next line of r without its line ending. A line
+// longer than maxLineSize is skipped, returning its start with
+// errLineTooLong so it can be dead lettered.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// The rest of the line overwrites the buffer line points into.
+		line = append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+		if err == nil || err == io.EOF {
+			err = errLineTooLong
+		}
+		return line, err
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// missingSwid returns the error for a record without a swid.
+func (m *Main) missingSwid() error {
+	if m.mapping != nil {
+		return fmt.Errorf("missing %s", m.mapping.Swid)
+	}
+	return errors.New("missing user_id")
+}
+
+// reject sends a malformed line to the dead letter output, aborting the
+// load once more than MaxErrors lines have been rejected. Records dead
+// lettered for other reasons, such as out of range values or unknown
+// countries, do not count towards MaxErrors.
+func (m *Main) reject(key string, row int, line []byte, err error) {
+	m.deadLetter.Add(key, row, line, err)
+	m.malformed.Add(1)
+	parseErrors.Inc()
+	if n := m.malformed.Get(); m.MaxErrors > 0 && n > m.MaxErrors {
+		m.Abort(fmt.Errorf("%d malformed lines exceeds the maximum of %d", n, m.MaxErrors))
 	}
 }
 
+// writerBatch is the most users a writer translates to columns at once.
+const writerBatch = 1000
+
+// insertUsers indexes users in batches of those queued, so that the
+// columns of each batch are committed to the key store in one request
+// before any of its users reach the indexer.
 func (m *Main) insertUsers(users <-chan u.User) {
+	idx := &rangeIndexer{Indexer: m.indexer, ranges: m.ranges}
+	batch := make([]u.User, 0, writerBatch)
+	swids := make([]string, 0, writerBatch)
 	for user := range users {
-		columnID := m.nexter.Next()
-		user.ColumnID = int32(columnID)
+		batch = append(batch[:0], user)
+	fill:
+		for len(batch) < writerBatch {
+			select {
+			case user, ok := <-users:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, user)
+			default:
+				break fill
+			}
+		}
 
-		// Enumerated from genderMap
-		genderID := uint64(u.GenderMap[user.Gender])
+		swids = swids[:0]
+		for i := range batch {
+			swids = append(swids, batch[i].Swid)
+		}
+		ids, err := m.translator.ColumnIDs(swids)
+		if err != nil {
+			// Users already queued are drained, not indexed.
+			m.unindexed.Add(len(batch))
+			m.Abort(err)
+			continue
+		}
+		for i := range batch {
+			m.insertUser(idx, ids[i], &batch[i])
+		}
+	}
+}
 
-		if user.Age != 0 {
-			m.indexer.AddValue("age_i", "age_i", columnID, int64(user.Age))
+// insertUser sends a user to idx as column columnID.
+func (m *Main) insertUser(idx *rangeIndexer, columnID uint64, user *u.User) {
+	idx.reset()
+	user.ColumnID = int32(columnID)
+	if m.mapping != nil {
+		if err := m.mapping.Index(idx, columnID, user.Doc); err != nil {
+			m.reject(user.Source, user.RowNum, user.Raw, err)
+		} else if idx.rejected != nil {
+			m.deadLetter.Add(user.Source, user.RowNum, user.Raw, idx.rejected)
+		}
+	} else {
+		m.indexUser(idx, columnID, user)
+		if idx.rejected != nil {
+			m.deadLetter.Add(user.Source, user.RowNum, user.Raw, idx.rejected)
 		}
+	}
+	m.totalRecs.Add(1)
+	recordsIndexed.Inc()
+}
 
-		//countryID, err2 := strconv.ParseUint(u.CountryMap[user.Registered_country].Country_code, 10, 64)
-		countryID := uint64(10)
+// indexUser sends the bits and values of a user to idx, using the built in
+// frames in user.Frames.
+func (m *Main) indexUser(idx Indexer, columnID uint64, user *u.User) {
+	// Enumerated from genderMap
+	genderID := uint64(u.GenderMap[user.Gender])
 
-		// Directly mapped
-		dmaID, err3 := strconv.ParseUint(user.Registered_dma_id, 10, 64)
+	if user.Age != 0 {
+		idx.AddValue("age_i", "age_i", columnID, int64(user.Age))
+	}
 
-		// Postal code hashed to int
-		postalID := get64BitHash(user.Registered_postal_code)
+	countryID, countryOK := m.resolveCountry(user)
 
-		m.indexer.AddBit("is_league_manager", columnID, boolToUInt64(user.Is_league_manager))
-		m.indexer.AddBit("plays_fantasy", columnID, boolToUInt64(user.Plays_fantasy))
-		m.indexer.AddBit("has_favorites", columnID, boolToUInt64(user.HasFavorites))
-		m.indexer.AddBit("has_notifications", columnID, boolToUInt64(user.HasNotifications))
-		m.indexer.AddBit("has_autostart", columnID, boolToUInt64(user.HasAutostart))
-		m.indexer.AddBit("is_insider", columnID, boolToUInt64(user.IsInsider))
-		m.indexer.AddBit("is_registered", columnID, boolToUInt64(user.Type == "registered"))
+	// Directly mapped
+	dmaID, err3 := strconv.ParseUint(user.Registered_dma_id, 10, 64)
 
-		// create the frames in the DB
-		if genderID != 0 {
-			m.indexer.AddBit("gender", columnID, genderID)
-		}
+	// Postal code hashed to int
+	postalID := get32BitHash(user.Registered_postal_code)
 
-		//if err2 == nil {
-		m.indexer.AddBit("country", columnID, countryID)
-		//}
+	idx.AddBit("is_league_manager", columnID, boolToUInt64(user.Is_league_manager))
+	idx.AddBit("plays_fantasy", columnID, boolToUInt64(user.Plays_fantasy))
+	idx.AddBit("has_favorites", columnID, boolToUInt64(user.HasFavorites))
+	idx.AddBit("has_notifications", columnID, boolToUInt64(user.HasNotifications))
+	idx.AddBit("has_autostart", columnID, boolToUInt64(user.HasAutostart))
+	idx.AddBit("is_insider", columnID, boolToUInt64(user.IsInsider))
+	idx.AddBit("is_registered", columnID, boolToUInt64(user.Type == "registered"))
 
-		if err3 == nil {
-			m.indexer.AddBit("dma_id", columnID, dmaID)
-		}
+	// create the frames in the DB
+	if genderID != 0 {
+		idx.AddBit("gender", columnID, genderID)
+	}
+
+	if countryOK {
+		idx.AddBit("country", columnID, countryID)
+	}
+
+	if err3 == nil {
+		idx.AddBit("dma_id", columnID, dmaID)
+	}
 
-		if postalID != 0 {
-			m.indexer.AddValue("postal_code", "postal_code", columnID, postalID)
-			//lat, long := u.GetLatLongFromPostalCode(user.Registered_country, user.Registered_postal_code)
-			//if lat != 0 && long != 0 {
-			//	latID, _ := u.MapValue("latitude", lat)
-			//	m.indexer.AddValue("latitude", "latitude", columnID, latID)
-			//	user.Latitude = lat
-			//	longID, _ := u.MapValue("longitude", long)
-			//	m.indexer.AddValue("longitude", "longitude", columnID, longID)
-			//	user.Longitude = long
-			//}
+	if postalID != 0 {
+		idx.AddValue("postal_code", "postal_code", columnID, postalID)
+		if u.GeoCodesLoaded() {
+			m.geoLookups.Add(1)
+			geocodeLookups.Inc()
+			lat, long, ok := u.GetLatLongFromPostalCode(user.Registered_country, user.Registered_postal_code)
+			if ok {
+				idx.AddValue("latitude", "latitude", columnID, u.ScaleCoordinate(lat))
+				user.Latitude = lat
+				idx.AddValue("longitude", "longitude", columnID, u.ScaleCoordinate(long))
+				user.Longitude = long
+			} else {
+				m.geoMisses.Add(1)
+				geocodeMisses.Inc()
+			}
 		}
+	}
 
-		if user.Stated_teams_favorites != nil {
-			for _, element := range user.Stated_teams_favorites {
-				if _, ok := u.StatedLeagueMap[element.Sport_id]; ok {
-					m.indexer.AddBit(u.StatedLeagueMap[element.Sport_id], columnID, uint64(element.Team_id))
-					m.indexer.AddBit("stated_leagues", columnID, uint64(element.Sport_id))
-				}
+	if user.Stated_teams_favorites != nil {
+		for _, element := range user.Stated_teams_favorites {
+			if _, ok := u.StatedLeagueMap[element.Sport_id]; ok {
+				idx.AddBit(u.StatedLeagueMap[element.Sport_id], columnID, uint64(element.Team_id))
+				idx.AddBit("stated_leagues", columnID, uint64(element.Sport_id))
+			} else {
+				m.unknownLeagues.Add(1)
 			}
 		}
+	}
 
-		if user.Derived_teams != nil {
-			for _, element := range user.Derived_teams {
-				switch element.Bucket {
-				case "High":
-					if _, ok := u.DerivedHighCCLeagueMap[element.League_id]; ok {
-						m.indexer.AddBit(u.DerivedHighCCLeagueMap[element.League_id], columnID, uint64(element.Team_id))
-						m.indexer.AddBit("league_cc_high", columnID, uint64(element.League_id))
-					}
-				case "Medium":
-					if _, ok := u.DerivedMediumCCLeagueMap[element.League_id]; ok {
-						m.indexer.AddBit(u.DerivedMediumCCLeagueMap[element.League_id], columnID, uint64(element.Team_id))
-						m.indexer.AddBit("league_cc_medium", columnID, uint64(element.League_id))
-					}
-				case "Low":
-					if _, ok := u.DerivedLowCCLeagueMap[element.League_id]; ok {
-						m.indexer.AddBit(u.DerivedLowCCLeagueMap[element.League_id], columnID, uint64(element.Team_id))
-						m.indexer.AddBit("league_cc_low", columnID, uint64(element.League_id))
-					}
+	if user.Derived_teams != nil {
+		for _, element := range user.Derived_teams {
+			switch element.Bucket {
+			case "High":
+				if _, ok := u.DerivedHighCCLeagueMap[element.League_id]; ok {
+					idx.AddBit(u.DerivedHighCCLeagueMap[element.League_id], columnID, uint64(element.Team_id))
+					idx.AddBit("league_cc_high", columnID, uint64(element.League_id))
+				} else {
+					m.unknownLeagues.Add(1)
+				}
+			case "Medium":
+				if _, ok := u.DerivedMediumCCLeagueMap[element.League_id]; ok {
+					idx.AddBit(u.DerivedMediumCCLeagueMap[element.League_id], columnID, uint64(element.Team_id))
+					idx.AddBit("league_cc_medium", columnID, uint64(element.League_id))
+				} else {
+					m.unknownLeagues.Add(1)
+				}
+			case "Low":
+				if _, ok := u.DerivedLowCCLeagueMap[element.League_id]; ok {
+					idx.AddBit(u.DerivedLowCCLeagueMap[element.League_id], columnID, uint64(element.Team_id))
+					idx.AddBit("league_cc_low", columnID, uint64(element.League_id))
+				} else {
+					m.unknownLeagues.Add(1)
 				}
 			}
 		}
-		m.indexer.AddValue("swid", "swid", columnID, get64BitHash(user.Swid))
-
-		m.indexer.AddValue("page_views", "page_views", columnID, int64(user.PageViews))
-		m.indexer.AddValue("time_spent", "time_spent", columnID, int64(user.TimeSpent))
-		m.indexer.AddValue("video_completes", "video_completes", columnID, int64(user.VideoCompletes))
-		m.indexer.AddValue("visits", "visits", columnID, int64(user.Visits))
-		m.indexer.AddValue("hits", "hits", columnID, int64(user.Hits))
-
-		//m.client.Query(m.index.SetColumnAttrs(columnID, map[string]interface{}{"swid": user.Swid}))
-		m.totalRecs.Add(1)
 	}
+	idx.AddValue("swid", "swid", columnID, swidHash(user.Swid))
+
+	idx.AddValue("page_views", "page_views", columnID, int64(user.PageViews))
+	idx.AddValue("time_spent", "time_spent", columnID, int64(user.TimeSpent))
+	idx.AddValue("video_completes", "video_completes", columnID, int64(user.VideoCompletes))
+	idx.AddValue("visits", "visits", columnID, int64(user.Visits))
+	idx.AddValue("hits", "hits", columnID, int64(user.Hits))
 }
 
 func boolToUInt64(cond bool) (v uint64) {
@@ -410,37 +744,121 @@ func boolToUInt64(cond bool) (v uint64) {
 	return
 }
 
-func get64BitHash(s string) int64 {
-	//return hash.MurmurHash64A([]byte(s), 0)
+func get32BitHash(s string) int64 {
 	return int64(hash.MurmurHash2([]byte(s), 0))
 }
 
+// swidHash returns the value stored in the swid field for a swid: a 64-bit
+// MurmurHash with the sign bit cleared, to fit a non-negative BSI field.
+func swidHash(s string) int64 {
+	return int64(hash.MurmurHash64A([]byte(s), 0) & math.MaxInt64)
+}
+
 // Init function initilizations loader.
-// Establishes session with Pilosa PDK and AWS S3 client
+// Establishes session with Pilosa PDK and either the local file source
+// or the AWS S3 client
 func (m *Main) Init() error {
 
-	log.Printf("Loading GeoCode data ...")
-	//u.LoadGeoCodes()
-
 	var err error
-	m.indexer, err = pdk.SetupPilosa(m.Hosts, m.IndexName, u.Frames, m.BufferSize)
+	if err = m.loadTables(); err != nil {
+		return err
+	}
+
+	if m.DryRun {
+		m.translator, err = OpenTempTranslator()
+	} else {
+		m.translator, err = OpenKeyStore(m.KeysPath, false)
+	}
 	if err != nil {
-		return fmt.Errorf("Error setting up Pilosa '%v'", err)
+		return err
+	}
+
+	if m.CheckpointPath != "" && !m.DryRun {
+		m.checkpoint, err = OpenCheckpoint(m.CheckpointPath, m.Resume)
+		if err != nil {
+			return err
+		}
+	} else if m.Resume {
+		return fmt.Errorf("Resuming requires a checkpoint file")
+	}
+
+	frames := u.Frames
+	if m.MappingPath != "" {
+		if m.mapping, err = LoadMapping(m.MappingPath); err != nil {
+			return err
+		}
+		frames = m.mapping.FrameSpecs()
+	}
+	if m.ranges, err = NewRanges(frames, m.OutOfRange); err != nil {
+		return err
+	}
+
+	if m.DryRun {
+		m.recorder = newRecordingIndexer(frames)
+		m.indexer = newInstrumentedIndexer(m.recorder, frames)
+	} else {
+		if err = m.checkFieldRanges(frames); err != nil {
+			return err
+		}
+		indexer, err := pdk.SetupPilosa(m.Hosts, m.IndexName, frames, m.BufferSize)
+		if err != nil {
+			return fmt.Errorf("Error setting up Pilosa '%v'", err)
+		}
+		m.indexer = newInstrumentedIndexer(indexer, frames)
+
+		if err = m.connectPilosa(); err != nil {
+			return err
+		}
+		if m.mapping == nil {
+			if err = m.publishCountries(); err != nil {
+				return err
+			}
+		}
 	}
-	//m.client = m.indexer.Client()
 
-	// Initialize S3 client
-	sess, err2 := session.NewSession(&aws.Config{
-		Region: aws.String(m.AWSRegion)},
-	)
+	if err = m.openSource(); err != nil {
+		return err
+	}
+
+	var svc *s3.S3
+	if _, _, ok := parseS3URL(m.DeadLetterPath); ok {
+		if svc, err = m.s3Service(); err != nil {
+			return err
+		}
+	}
+	m.deadLetter, err = NewDeadLetter(m.DeadLetterPath, svc)
+	return err
+}
 
-	if err2 != nil {
-		return fmt.Errorf("Creating S3 session: %v", err2)
+// loadTables loads the configured country table and gazetteer.
+func (m *Main) loadTables() error {
+	if m.CountriesPath != "" {
+		if err := u.LoadCountries(m.CountriesPath); err != nil {
+			return err
+		}
 	}
 
-	// Create S3 service client
-	m.S3svc = s3.New(sess)
+	if m.GeoCodesPath != "" {
+		log.Printf("Loading GeoCode data ...")
+		if err := u.LoadGeoCodes(m.GeoCodesPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// openSource sets Source to the local paths, or else the S3 bucket and
+// prefix.
+func (m *Main) openSource() error {
+	if len(m.LocalPaths) > 0 {
+		m.Source = NewFileSource(m.LocalPaths)
+		return nil
+	}
+	svc, err := m.s3Service()
+	if err != nil {
+		return err
+	}
+	m.Source = NewS3Source(svc, m.Bucket, m.Prefix)
 	return nil
 }
 
@@ -448,10 +866,26 @@ func (m *Main) Close() {
 	if err := m.indexer.Close(); err != nil {
 		log.Fatal(err)
 	}
+	collisions := m.translator.Collisions()
+	if n := len(collisions); n > 0 {
+		log.Printf("Found %d swid hash collisions", n)
+	}
+	if m.CollisionsPath != "" {
+		if err := WriteCollisions(m.CollisionsPath, collisions); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := m.translator.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := m.deadLetter.Close(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // printStats outputs to Log current status of loader
 // Includes data on processed: bytes, records, time duration in seconds, and rate of bytes per sec"
+// Bytes are counted after decompression; bytes read from the source are reported separately.
 func (m *Main) printStats() *time.Ticker {
 	t := time.NewTicker(time.Second * 10)
 	start := time.Now()
@@ -460,6 +894,12 @@ func (m *Main) printStats() *time.Ticker {
 			duration := time.Since(start)
 			bytes := m.BytesProcessed()
 			log.Printf("Bytes: %s, Records: %v, Duration: %v, Rate: %v/s, %v rec/s", pdk.Bytes(bytes), m.totalRecs.Get(), duration, pdk.Bytes(float64(bytes)/duration.Seconds()), float64(m.totalRecs.Get())/duration.Seconds())
+			if compressed := m.compressedBytes.Get(); compressed > 0 {
+				log.Printf("Read: %s, Rate: %v/s, Compression ratio: %.2f", pdk.Bytes(compressed), pdk.Bytes(float64(compressed)/duration.Seconds()), float64(bytes)/float64(compressed))
+			}
+			// A full file queue means reading is the bottleneck, a full
+			// user queue means indexing is.
+			log.Printf("Queues: files %d/%d, users %d/%d", len(m.files), cap(m.files), len(m.users), cap(m.users))
 		}
 	}()
 	return t
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	u "github.com/travisturner/pilosa-loader/user"
+)
+
+// indexed returns the rows set in col of every frame of idx, and the value
+// of col in every field named after its frame.
+func indexed(idx *MemoryIndexer, col uint64) (map[string][]uint64, map[string]int64) {
+	bits := make(map[string][]uint64)
+	values := make(map[string]int64)
+	for _, frame := range idx.Frames() {
+		if rows := idx.Rows(frame, col); len(rows) > 0 {
+			bits[frame] = rows
+		}
+		if v, ok := idx.Value(frame, frame, col); ok {
+			values[frame] = v
+		}
+	}
+	return bits, values
+}
+
+func TestIndexUser(t *testing.T) {
+	const col = 7
+	baseBits := map[string][]uint64{
+		"gender":            {2},
+		"dma_id":            {501},
+		"is_league_manager": {0},
+		"plays_fantasy":     {1},
+		"has_favorites":     {1},
+		"has_notifications": {0},
+		"has_autostart":     {0},
+		"is_insider":        {0},
+		"is_registered":     {1},
+	}
+	baseValues := map[string]int64{
+		"age_i":           30,
+		"postal_code":     get32BitHash("10001"),
+		"swid":            swidHash("{ABC}"),
+		"page_views":      10,
+		"time_spent":      20,
+		"video_completes": 3,
+		"visits":          4,
+		"hits":            5,
+	}
+
+	tests := []struct {
+		name    string
+		stated  []u.Favorite
+		derived []u.Favorite
+		bits    map[string][]uint64
+		unknown int64
+	}{
+		{
+			name: "no favorites",
+		},
+		{
+			name:   "stated",
+			stated: []u.Favorite{{Sport_id: 10, Team_id: 5}, {Sport_id: 28, Team_id: 12}},
+			bits: map[string][]uint64{
+				"stated_teams_mlb": {5},
+				"stated_teams_nfl": {12},
+				"stated_leagues":   {10, 28},
+			},
+		},
+		{
+			name: "derived buckets",
+			derived: []u.Favorite{
+				{Bucket: "High", League_id: 10, Team_id: 5},
+				{Bucket: "Medium", League_id: 46, Team_id: 7},
+				{Bucket: "Low", League_id: 600, Team_id: 9},
+				{Bucket: "Low", League_id: 41, Team_id: 300},
+			},
+			bits: map[string][]uint64{
+				"derived_high_cc_teams_mlb":   {5},
+				"league_cc_high":              {10},
+				"derived_medium_cc_teams_nba": {7},
+				"league_cc_medium":            {46},
+				"derived_low_cc_teams_soccer": {9},
+				"derived_low_cc_teams_ncaab":  {300},
+				"league_cc_low":               {41, 600},
+			},
+		},
+		{
+			name:    "unknown league",
+			stated:  []u.Favorite{{Sport_id: 999, Team_id: 1}},
+			derived: []u.Favorite{{Bucket: "High", League_id: 999, Team_id: 1}, {Bucket: "Low", League_id: 998, Team_id: 2}},
+			unknown: 3,
+		},
+		{
+			name:    "unknown bucket",
+			derived: []u.Favorite{{Bucket: "Extreme", League_id: 10, Team_id: 5}, {Bucket: "", League_id: 46, Team_id: 7}},
+		},
+	}
+
+	for _, tt := range tests {
+		user := &u.User{
+			Swid:                   "{ABC}",
+			Type:                   "registered",
+			Gender:                 "F",
+			Age:                    30,
+			Registered_dma_id:      "501",
+			Registered_postal_code: "10001",
+			Plays_fantasy:          true,
+			HasFavorites:           true,
+			PageViews:              10,
+			TimeSpent:              20,
+			VideoCompletes:         3,
+			Visits:                 4,
+			Hits:                   5,
+			Stated_teams_favorites: tt.stated,
+			Derived_teams:          tt.derived,
+		}
+		m := NewMain()
+		idx := NewMemoryIndexer()
+		m.indexUser(idx, col, user)
+
+		wantBits := make(map[string][]uint64)
+		for frame, rows := range baseBits {
+			wantBits[frame] = rows
+		}
+		for frame, rows := range tt.bits {
+			wantBits[frame] = rows
+		}
+		bits, values := indexed(idx, col)
+		if !reflect.DeepEqual(bits, wantBits) {
+			t.Errorf("%s: bits\n got %v\nwant %v", tt.name, bits, wantBits)
+		}
+		if !reflect.DeepEqual(values, baseValues) {
+			t.Errorf("%s: values\n got %v\nwant %v", tt.name, values, baseValues)
+		}
+		if n := m.unknownLeagues.Get(); n != tt.unknown {
+			t.Errorf("%s: unknown leagues %d, want %d", tt.name, n, tt.unknown)
+		}
+	}
+}
+
+func TestIndexUserAgeZero(t *testing.T) {
+	m := NewMain()
+	idx := NewMemoryIndexer()
+	m.indexUser(idx, 1, &u.User{Swid: "{ABC}", Registered_dma_id: "x"})
+
+	if _, ok := idx.Value("age_i", "age_i", 1); ok {
+		t.Errorf("age 0 indexed")
+	}
+	if _, ok := idx.Value("postal_code", "postal_code", 1); ok {
+		t.Errorf("empty postal code indexed")
+	}
+	if rows := idx.Rows("dma_id", 1); len(rows) > 0 {
+		t.Errorf("bad dma id indexed as %v", rows)
+	}
+	if rows := idx.Rows("gender", 1); len(rows) > 0 {
+		t.Errorf("missing gender indexed as %v", rows)
+	}
+	if rows := idx.Rows("is_registered", 1); !reflect.DeepEqual(rows, []uint64{0}) {
+		t.Errorf("is_registered rows %v, want [0]", rows)
+	}
+}
+
+func TestMaxErrorsCountsMalformedOnly(t *testing.T) {
+	m := NewMain()
+	m.MaxErrors = 1
+	m.deadLetter, _ = NewDeadLetter("", nil)
+	for i := 0; i < 3; i++ {
+		m.deadLetter.Add("users.json", i, nil, errors.New("age_i value 200 outside 0..130"))
+	}
+	m.reject("users.json", 4, []byte("{"), errors.New("unexpected end of JSON input"))
+	if m.Stopped() {
+		t.Fatalf("aborted after one malformed line and three other dead letters")
+	}
+	m.reject("users.json", 5, []byte("{"), errors.New("unexpected end of JSON input"))
+	if !m.Stopped() {
+		t.Errorf("not aborted after two malformed lines")
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", maxLineSize+10)
+	r := bufio.NewReaderSize(strings.NewReader("{\"a\":1}\r\n"+long+"\n\n{\"b\":2}"), maxLineSize)
+	want := []struct {
+		line string
+		err  error
+	}{
+		{`{"a":1}`, nil},
+		{long[:maxLineSize], errLineTooLong},
+		{"", nil},
+		{`{"b":2}`, nil},
+		{"", io.EOF},
+	}
+	for i, w := range want {
+		line, err := readLine(r)
+		if string(line) != w.line || err != w.err {
+			t.Errorf("line %d: got %.20q, %v, want %.20q, %v", i+1, line, err, w.line, w.err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+)
+
+// lookupMain implements the lookup subcommand, which translates column IDs
+// back to swids through the key store. Column IDs are read one per line
+// from stdin, or taken from the result of a PQL bitmap query.
+func lookupMain(args []string) {
+	fs := flag.NewFlagSet("lookup", flag.ExitOnError)
+	keys := fs.String("keys", "keys.db", "Path of the key store mapping swids to column IDs, or the http:// URL of a key server.")
+	query := fs.String("query", "", "PQL bitmap query whose columns are looked up, instead of reading column IDs from stdin.")
+	indexName := fs.String("index", "user360", "Index name.")
+	hosts := fs.String("hosts", "localhost:10101", "Pilosa server hosts as comma separated list.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s lookup [OPTIONS] < column IDs\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s lookup [OPTIONS] -query <PQL>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	t, err := OpenKeyStore(*keys, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer t.Close()
+
+	var columns []uint64
+	if *query != "" {
+		columns, err = queryColumns(strings.Split(*hosts, ","), *indexName, *query)
+	} else {
+		columns, err = readColumns(os.Stdin)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	missing := 0
+	for _, col := range columns {
+		swid, ok, err := t.Swid(col)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			missing++
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%s\n", col, swid)
+	}
+	if missing > 0 {
+		log.Printf("%d of %d columns are not in key store %s", missing, len(columns), *keys)
+	}
+}
+
+// readColumns parses one column ID per line, skipping blank lines.
+func readColumns(r io.Reader) ([]uint64, error) {
+	var columns []uint64
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" {
+			continue
+		}
+		col, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad column ID %q: %v", line, err)
+		}
+		columns = append(columns, col)
+	}
+	return columns, scan.Err()
+}
+
+// queryColumns runs a PQL bitmap query and returns the columns it sets.
+func queryColumns(hosts []string, indexName, pql string) ([]uint64, error) {
+	client, err := gopilosa.NewClientFromAddresses(hosts, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to Pilosa: %v", err)
+	}
+	index, err := gopilosa.NewIndex(indexName, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Query(index.RawQuery(pql), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Querying %s: %v", indexName, err)
+	}
+	result := resp.Result()
+	if result == nil || result.Bitmap == nil {
+		return nil, fmt.Errorf("Query %q did not return a bitmap", pql)
+	}
+	return result.Bitmap.Bits, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	"github.com/pilosa/pdk"
+	u "github.com/travisturner/pilosa-loader/user"
+)
+
+// Field mapping types.
+const (
+	// MapSet sets the bit whose row is the integer value.
+	MapSet = "set"
+	// MapRanked is MapSet on a frame with a ranked cache.
+	MapRanked = "ranked"
+	// MapBool sets row 1 for true and row 0 for false.
+	MapBool = "bool"
+	// MapInt stores the integer value in a BSI field.
+	MapInt = "int"
+	// MapHash stores a hash of the string value in a BSI field, 32 bits
+	// wide unless Max is larger than math.MaxUint32.
+	MapHash = "hash"
+	// MapEnum sets the row which Values assigns to the string value.
+	// Values missing from Values are indexed as Default if it is given,
+	// and skipped otherwise.
+	MapEnum = "enum"
+	// MapCountry sets the ISO 3166 numeric code of a country code or name
+	// found in the country table, as the built in country frame does.
+	MapCountry = "country"
+	// MapLatitude and MapLongitude store the location of a postal code,
+	// looked up in the gazetteer together with the country at Country, in
+	// a BSI field. They are skipped when no gazetteer is loaded.
+	MapLatitude  = "latitude"
+	MapLongitude = "longitude"
+)
+
+const defaultCacheSize = 50000
+
+// Mapping declares how the fields of each JSON record are indexed.
+// It replaces the built in logic of insertUsers when a mapping file is
+// given, so attributes can be added without changing the loader.
+//
+// mapping.json indexes the same bits and values as the built in frames,
+// except that a dma_id which is not a number is rejected rather than
+// skipped, and country and gazetteer misses are only counted in the
+// metrics.
+type Mapping struct {
+	// Swid is the dot separated path of the swid identifying each record,
+	// user_id if not given.
+	Swid   string          `json:"swid"`
+	Fields []*FieldMapping `json:"fields"`
+}
+
+// FieldMapping indexes the value at one JSON path of a record into a frame.
+type FieldMapping struct {
+	// Path is the dot separated path of the value within the record, or
+	// within each element of Each.
+	Path string `json:"path"`
+	// Each optionally names an array in the record. Path and Where are then
+	// evaluated against every element of the array.
+	Each string `json:"each,omitempty"`
+	// Where optionally restricts the mapping to records, or elements, whose
+	// value at each path equals the one given.
+	Where map[string]interface{} `json:"where,omitempty"`
+
+	Frame string `json:"frame"`
+	Type  string `json:"type"`
+
+	// Min and Max bound the values of int and hash fields.
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+	// CacheSize of set, ranked, bool and enum frames.
+	CacheSize uint `json:"cacheSize,omitempty"`
+	Inverse   bool `json:"inverse,omitempty"`
+	// Values maps the strings of an enum to rows.
+	Values map[string]uint64 `json:"values,omitempty"`
+	// Default is indexed in place of a missing or null value.
+	Default interface{} `json:"default,omitempty"`
+	// OmitEmpty skips empty strings and zero numbers.
+	OmitEmpty bool `json:"omitEmpty,omitempty"`
+	// Country is the dot separated path of the country which latitude and
+	// longitude fields look postal codes up in.
+	Country string `json:"country,omitempty"`
+}
+
+// LoadMapping reads and validates the mapping file at path.
+func LoadMapping(path string) (*Mapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Opening mapping: %v", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	m := &Mapping{}
+	if err := dec.Decode(m); err != nil {
+		return nil, fmt.Errorf("Parsing mapping %s: %v", path, err)
+	}
+	if m.Swid == "" {
+		m.Swid = "user_id"
+	}
+	for i, fm := range m.Fields {
+		if err := fm.validate(); err != nil {
+			return nil, fmt.Errorf("Mapping %s field %d: %v", path, i, err)
+		}
+	}
+	return m, nil
+}
+
+func (fm *FieldMapping) validate() error {
+	if fm.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	if fm.Frame == "" {
+		return fmt.Errorf("missing frame for %s", fm.Path)
+	}
+	switch fm.Type {
+	case MapSet, MapRanked, MapBool, MapCountry:
+	case MapLatitude, MapLongitude:
+		if fm.Min == 0 && fm.Max == 0 {
+			fm.Min, fm.Max = math.MinInt32, math.MaxInt32
+		}
+	case MapInt:
+		if fm.Max <= fm.Min {
+			return fmt.Errorf("bad range %d..%d for %s", fm.Min, fm.Max, fm.Path)
+		}
+	case MapHash:
+		if fm.Min == 0 && fm.Max == 0 {
+			fm.Max = int(math.MaxUint32)
+		}
+	case MapEnum:
+		if len(fm.Values) == 0 {
+			return fmt.Errorf("enum %s has no values", fm.Path)
+		}
+		if fm.Default != nil {
+			if _, ok := fm.Values[fmt.Sprint(fm.Default)]; !ok {
+				return fmt.Errorf("enum %s default %v is not one of its values", fm.Path, fm.Default)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q for %s", fm.Type, fm.Path)
+	}
+	return nil
+}
+
+// FrameSpecs returns the frames written by the mapping. Frames targeted by
+// several fields take their options from the first.
+func (m *Mapping) FrameSpecs() []pdk.FrameSpec {
+	seen := make(map[string]bool)
+	var specs []pdk.FrameSpec
+	for _, fm := range m.Fields {
+		if seen[fm.Frame] {
+			continue
+		}
+		seen[fm.Frame] = true
+		specs = append(specs, fm.frameSpec())
+	}
+	return specs
+}
+
+func (fm *FieldMapping) frameSpec() pdk.FrameSpec {
+	switch fm.Type {
+	case MapInt, MapHash, MapLatitude, MapLongitude:
+		return pdk.NewFieldFrameSpec(fm.Frame, fm.Min, fm.Max)
+	}
+	spec := pdk.FrameSpec{
+		Name:           fm.Frame,
+		CacheType:      gopilosa.CacheTypeRanked,
+		CacheSize:      fm.CacheSize,
+		InverseEnabled: fm.Inverse,
+	}
+	if fm.Type == MapSet {
+		spec.CacheType = gopilosa.CacheTypeLRU
+	}
+	if spec.CacheSize == 0 {
+		spec.CacheSize = defaultCacheSize
+	}
+	return spec
+}
+
+// Decode decodes a JSON record, returning it along with its swid.
+func (m *Mapping) Decode(record []byte) (interface{}, string, error) {
+	dec := json.NewDecoder(bytes.NewReader(record))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, "", err
+	}
+	switch swid := lookupPath(doc, m.Swid).(type) {
+	case nil:
+	case string:
+		return doc, swid, nil
+	case json.Number:
+		return doc, swid.String(), nil
+	default:
+		return nil, "", fmt.Errorf("%s: %v is not a string", m.Swid, swid)
+	}
+	return doc, "", nil
+}
+
+// Index indexes a record returned by Decode into columnID. Values that
+// cannot be converted are skipped and the first such error is returned
+// once the rest of the record has been indexed.
+func (m *Mapping) Index(indexer Indexer, columnID uint64, doc interface{}) error {
+	var firstErr error
+	for _, fm := range m.Fields {
+		if err := fm.index(indexer, columnID, doc); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (fm *FieldMapping) index(indexer Indexer, columnID uint64, doc interface{}) error {
+	if fm.Each == "" {
+		return fm.indexValue(indexer, columnID, doc)
+	}
+	elems, ok := lookupPath(doc, fm.Each).([]interface{})
+	if !ok {
+		return nil
+	}
+	var firstErr error
+	for _, elem := range elems {
+		if err := fm.indexValue(indexer, columnID, elem); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (fm *FieldMapping) indexValue(indexer Indexer, columnID uint64, doc interface{}) error {
+	for path, want := range fm.Where {
+		if fmt.Sprint(lookupPath(doc, path)) != fmt.Sprint(want) {
+			return nil
+		}
+	}
+	v := lookupPath(doc, fm.Path)
+	if v == nil {
+		v = fm.Default
+	}
+	if v == nil || (fm.OmitEmpty && isEmpty(v)) {
+		return nil
+	}
+
+	switch fm.Type {
+	case MapSet, MapRanked:
+		row, err := toUint(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fm.Path, err)
+		}
+		indexer.AddBit(fm.Frame, columnID, row)
+	case MapBool:
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a boolean", fm.Path, v)
+		}
+		indexer.AddBit(fm.Frame, columnID, boolToUInt64(b))
+	case MapInt:
+		n, err := toInt(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fm.Path, err)
+		}
+		indexer.AddValue(fm.Frame, fm.Frame, columnID, n)
+	case MapHash:
+		if fm.Max > math.MaxUint32 {
+			indexer.AddValue(fm.Frame, fm.Frame, columnID, swidHash(fmt.Sprint(v)))
+		} else {
+			indexer.AddValue(fm.Frame, fm.Frame, columnID, get32BitHash(fmt.Sprint(v)))
+		}
+	case MapEnum:
+		row, ok := fm.Values[fmt.Sprint(v)]
+		if !ok && fm.Default != nil {
+			row, ok = fm.Values[fmt.Sprint(fm.Default)]
+		}
+		if ok {
+			indexer.AddBit(fm.Frame, columnID, row)
+		}
+	case MapCountry:
+		if c, ok := u.LookupCountry(fmt.Sprint(v)); ok {
+			indexer.AddBit(fm.Frame, columnID, c.Numeric)
+		} else {
+			countryMisses.Inc()
+		}
+	case MapLatitude, MapLongitude:
+		if !u.GeoCodesLoaded() {
+			return nil
+		}
+		country, _ := lookupPath(doc, fm.Country).(string)
+		if c, ok := u.LookupCountry(country); ok {
+			country = c.Alpha2
+		}
+		// Each location is counted once, under its latitude.
+		if fm.Type == MapLatitude {
+			geocodeLookups.Inc()
+		}
+		lat, long, ok := u.GetLatLongFromPostalCode(country, fmt.Sprint(v))
+		if !ok {
+			if fm.Type == MapLatitude {
+				geocodeMisses.Inc()
+			}
+			return nil
+		}
+		if fm.Type == MapLatitude {
+			indexer.AddValue(fm.Frame, fm.Frame, columnID, u.ScaleCoordinate(lat))
+		} else {
+			indexer.AddValue(fm.Frame, fm.Frame, columnID, u.ScaleCoordinate(long))
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether v is an empty string or a zero number.
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return v == ""
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == 0
+	}
+	return false
+}
+
+// lookupPath returns the value at a dot separated path within doc, or nil.
+func lookupPath(doc interface{}, path string) interface{} {
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		doc = obj[name]
+	}
+	return doc
+}
+
+func toUint(v interface{}) (uint64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return strconv.ParseUint(v.String(), 10, 64)
+	case string:
+		return strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+	}
+	return 0, fmt.Errorf("%v is not an unsigned integer", v)
+}
+
+func toInt(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		f, err := v.Float64()
+		return int64(f), err
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	}
+	return 0, fmt.Errorf("%v is not an integer", v)
+}
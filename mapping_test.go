@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/pilosa/pdk"
+	u "github.com/travisturner/pilosa-loader/user"
+)
+
+// TestMappingMatchesIndexUser checks that mapping.json indexes the same
+// bits and values as the built in frames.
+func TestMappingMatchesIndexUser(t *testing.T) {
+	gazetteer, err := ioutil.TempFile("", "geocodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(gazetteer.Name())
+	gazetteer.WriteString("US\t10001\tNew York\tNew York\tNY\tNew York\t061\t\t\t40.7484\t-73.9967\t4\n")
+	gazetteer.Close()
+	if err := u.LoadGeoCodes(gazetteer.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	mapping, err := LoadMapping("mapping.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []string{
+		`{"user_id": "{A}", "user_type": "registered", "gender": "F", "age": 30, "registered_country": "USA", "registered_dma_id": "501", "registered_postal_code": "10001",
+		  "is_league_manager": true, "plays_fantasy": true, "has_favorites": true, "has_notifications": false, "has_autostart": true, "is_insider": false,
+		  "page_views": 10, "time_spent": 20, "video_completes": 3, "visits": 4, "hits": 5,
+		  "stated_teams_favorites": [{"sport_id": 10, "team_id": 5}, {"sport_id": 999, "team_id": 1}],
+		  "derived_team_rf": [{"bucket": "High", "league_id": 46, "team_id": 7}, {"bucket": "Low", "league_id": 600, "team_id": 9}, {"bucket": "Extreme", "league_id": 10, "team_id": 5}]}`,
+		`{"user_id": "{B}", "user_type": "", "gender": "X", "age": 0, "registered_dma_id": "", "registered_postal_code": "", "page_views": 0}`,
+		`{"user_id": "{C}", "user_type": "anonymous", "registered_country": "Atlantis", "registered_postal_code": "10001"}`,
+		`{"user_id": "{D}", "gender": "U", "registered_country": "us", "registered_postal_code": "99999"}`,
+	}
+
+	m := NewMain()
+	for i, record := range records {
+		col := uint64(i)
+		var user u.User
+		if err := json.Unmarshal([]byte(record), &user); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		builtin := NewMemoryIndexer()
+		m.indexUser(builtin, col, &user)
+
+		doc, swid, err := mapping.Decode([]byte(record))
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if swid != user.Swid {
+			t.Errorf("record %d: mapped swid %q, want %q", i, swid, user.Swid)
+		}
+		mapped := NewMemoryIndexer()
+		if err := mapping.Index(mapped, col, doc); err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+
+		wantBits, wantValues := indexed(builtin, col)
+		bits, values := indexed(mapped, col)
+		if !reflect.DeepEqual(bits, wantBits) {
+			t.Errorf("record %d: mapped bits\n got %v\nwant %v", i, bits, wantBits)
+		}
+		if !reflect.DeepEqual(values, wantValues) {
+			t.Errorf("record %d: mapped values\n got %v\nwant %v", i, values, wantValues)
+		}
+	}
+}
+
+// TestMappingFrames checks that mapping.json creates the built in frames.
+func TestMappingFrames(t *testing.T) {
+	mapping, err := LoadMapping("mapping.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs := mapping.FrameSpecs()
+	want := append([]pdk.FrameSpec(nil), u.Frames...)
+	for _, frames := range [][]pdk.FrameSpec{specs, want} {
+		sort.Slice(frames, func(i, j int) bool { return frames[i].Name < frames[j].Name })
+	}
+	if !reflect.DeepEqual(specs, want) {
+		t.Errorf("mapped frames\n got %+v\nwant %+v", specs, want)
+	}
+}
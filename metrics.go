@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/pilosa/pdk"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	objectsListed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "objects_listed_total",
+		Help:      "Objects listed from the source.",
+	})
+	objectsCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "objects_completed_total",
+		Help:      "Objects read to the end.",
+	})
+	objectsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "objects_failed_total",
+		Help:      "Objects which could not be read.",
+	})
+	linesRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "lines_read_total",
+		Help:      "Lines read from objects.",
+	})
+	recordsIndexed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "records_indexed_total",
+		Help:      "Records sent to the indexer.",
+	})
+	parseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "parse_errors_total",
+		Help:      "Lines rejected as malformed.",
+	})
+	bitsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "bits_sent_total",
+		Help:      "Bits sent to the indexer.",
+	}, []string{"frame"})
+	valuesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "values_sent_total",
+		Help:      "BSI field values sent to the indexer.",
+	}, []string{"frame"})
+	geocodeLookups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "geocode_lookups_total",
+		Help:      "Postal codes looked up in the gazetteer.",
+	})
+	geocodeMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "geocode_misses_total",
+		Help:      "Postal codes not found in the gazetteer.",
+	})
+	countryMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "loader",
+		Name:      "unknown_countries_total",
+		Help:      "Users whose registered country is not in the country table.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(objectsListed, objectsCompleted, objectsFailed,
+		linesRead, recordsIndexed, parseErrors, bitsSent, valuesSent,
+		geocodeLookups, geocodeMisses, countryMisses)
+}
+
+// serveMetrics exposes the loader metrics, including the depth of the
+// file and user queues, at /metrics on addr.
+func (m *Main) serveMetrics(addr string) {
+	for name, depth := range map[string]func() float64{
+		"files": func() float64 { return float64(len(m.files)) },
+		"users": func() float64 { return float64(len(m.users)) },
+	} {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "loader",
+			Name:        "queue_depth",
+			Help:        "Items waiting in a pipeline queue.",
+			ConstLabels: prometheus.Labels{"queue": name},
+		}, depth))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server: %v", err)
+		}
+	}()
+}
+
+// instrumentedIndexer counts the bits and values sent to an Indexer.
+// Import latency is not measured: the pdk indexer imports full buffers in
+// its own goroutines with its own client, so from here only the final
+// flush in Close could be timed, which says nothing while a load runs.
+type instrumentedIndexer struct {
+	Indexer
+	// bits and values hold the counters of each frame, so they are not
+	// looked up for every bit. They are only written by
+	// newInstrumentedIndexer.
+	bits   map[string]prometheus.Counter
+	values map[string]prometheus.Counter
+}
+
+func newInstrumentedIndexer(idx Indexer, frames []pdk.FrameSpec) *instrumentedIndexer {
+	i := &instrumentedIndexer{
+		Indexer: idx,
+		bits:    make(map[string]prometheus.Counter, len(frames)),
+		values:  make(map[string]prometheus.Counter, len(frames)),
+	}
+	for _, spec := range frames {
+		if len(spec.Fields) > 0 {
+			i.values[spec.Name] = valuesSent.WithLabelValues(spec.Name)
+		} else {
+			i.bits[spec.Name] = bitsSent.WithLabelValues(spec.Name)
+		}
+	}
+	return i
+}
+
+func (i *instrumentedIndexer) AddBit(frame string, col uint64, row uint64) {
+	i.Indexer.AddBit(frame, col, row)
+	if c, ok := i.bits[frame]; ok {
+		c.Inc()
+	} else {
+		bitsSent.WithLabelValues(frame).Inc()
+	}
+}
+
+func (i *instrumentedIndexer) AddValue(frame, field string, col uint64, val int64) {
+	i.Indexer.AddValue(frame, field, col, val)
+	if c, ok := i.values[frame]; ok {
+		c.Inc()
+	} else {
+		valuesSent.WithLabelValues(frame).Inc()
+	}
+}
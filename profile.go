@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Distribution types for integer fields.
+const (
+	DistUniform   = "uniform"
+	DistNormal    = "normal"
+	DistLogNormal = "lognormal"
+	DistZipf      = "zipf"
+)
+
+// Profile describes the distributions the generator draws each user field
+// from. Fields left out of a profile file keep the DefaultProfile values;
+// give a league or bucket a weight of 0 to leave it out.
+type Profile struct {
+	// Registered is the probability of a registered user.
+	Registered float64 `json:"registered"`
+	// Gender weights each gender code.
+	Gender map[string]float64 `json:"gender"`
+	// Ints holds the distribution of each integer field, keyed by its
+	// JSON name: age, registered_dma_id, registered_postal_code,
+	// page_views, time_spent, video_completes, visits and hits.
+	Ints map[string]*Dist `json:"ints"`
+	// Flags holds the probability of each boolean field, keyed by its
+	// JSON name.
+	Flags map[string]*Flag `json:"flags"`
+	// Stated and Derived describe the favorite teams of a user.
+	Stated  *Favorites `json:"stated_teams_favorites"`
+	Derived *Favorites `json:"derived_team_rf"`
+
+	gender *weighted
+}
+
+// Dist is the distribution of an integer field, limited to [Min, Max).
+type Dist struct {
+	Type string  `json:"type"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	// Mean and StdDev parameterize a normal distribution.
+	Mean   float64 `json:"mean,omitempty"`
+	StdDev float64 `json:"stddev,omitempty"`
+	// Mu and Sigma are the mean and standard deviation of the logarithm
+	// of a log-normal distribution.
+	Mu    float64 `json:"mu,omitempty"`
+	Sigma float64 `json:"sigma,omitempty"`
+	// S is the exponent of a zipf distribution over Min upwards.
+	S float64 `json:"s,omitempty"`
+}
+
+// Flag is the probability of a boolean field being true. When Given names
+// another flag which is true, PGiven is used instead of P, correlating
+// the two flags.
+type Flag struct {
+	P      float64 `json:"p"`
+	Given  string  `json:"given,omitempty"`
+	PGiven float64 `json:"pGiven,omitempty"`
+}
+
+// Favorites describes a list of favorite teams.
+type Favorites struct {
+	// Counts weights the number of favorites, from zero upwards.
+	Counts []float64 `json:"counts"`
+	// Leagues weights each league, keyed by league ID.
+	Leagues map[string]float64 `json:"leagues"`
+	// TeamSkew is the zipf exponent of team popularity within a league,
+	// with uniform popularity when 0.
+	TeamSkew float64 `json:"teamSkew"`
+	// Buckets weights each cross consumption bucket.
+	Buckets map[string]float64 `json:"buckets"`
+
+	counts  *weighted
+	leagues *weighted
+	buckets *weighted
+}
+
+// flagOrder is the order flags are drawn in, before any flag given on them.
+var flagOrder = []string{"is_league_manager", "plays_fantasy", "has_favorites", "has_notifications", "has_autostart", "is_insider"}
+
+// DefaultProfile returns uniform distributions matching the original
+// generator.
+func DefaultProfile() *Profile {
+	uniform := func(min, max float64) *Dist { return &Dist{Type: DistUniform, Min: min, Max: max} }
+	flag := func(p float64) *Flag { return &Flag{P: p} }
+	favorites := func() *Favorites {
+		f := &Favorites{
+			Counts:  []float64{7, 3, 2, 1},
+			Leagues: make(map[string]float64),
+			Buckets: make(map[string]float64),
+		}
+		for _, l := range leagues {
+			f.Leagues[strconv.Itoa(int(l))] = 1
+		}
+		for _, b := range buckets {
+			f.Buckets[b] = 1
+		}
+		return f
+	}
+	return &Profile{
+		Registered: 0.1,
+		Gender:     map[string]float64{"M": 0.4, "F": 0.4, "U": 0.2},
+		Ints: map[string]*Dist{
+			"age":                    uniform(10, 100),
+			"registered_dma_id":      uniform(0, 10000),
+			"registered_postal_code": uniform(10000, 99999),
+			"page_views":             uniform(0, 65535),
+			"time_spent":             uniform(0, 10000000),
+			"video_completes":        uniform(0, 65535),
+			"visits":                 uniform(0, 65535),
+			"hits":                   uniform(0, 65535),
+		},
+		Flags: map[string]*Flag{
+			"is_league_manager": flag(0.05),
+			"plays_fantasy":     flag(0.25),
+			"has_favorites":     flag(0.2),
+			"has_notifications": flag(0.1),
+			"has_autostart":     flag(0.2),
+			"is_insider":        flag(0.2),
+		},
+		Stated:  favorites(),
+		Derived: favorites(),
+	}
+}
+
+// LoadProfile reads a profile file over the DefaultProfile. An empty path
+// returns the DefaultProfile.
+func LoadProfile(path string) (*Profile, error) {
+	p := DefaultProfile()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Opening profile: %v", err)
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(p); err != nil {
+			return nil, fmt.Errorf("Parsing profile %s: %v", path, err)
+		}
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("Profile %s: %v", path, err)
+	}
+	return p, nil
+}
+
+func (p *Profile) compile() error {
+	var err error
+	if p.gender, err = newWeighted(p.Gender); err != nil {
+		return fmt.Errorf("gender: %v", err)
+	}
+	defaults := DefaultProfile()
+	for name, d := range p.Ints {
+		if _, ok := defaults.Ints[name]; !ok {
+			return fmt.Errorf("unknown integer field %q", name)
+		}
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	for name, f := range p.Flags {
+		if _, ok := defaults.Flags[name]; !ok {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if f.Given == "" {
+			continue
+		}
+		if g, ok := p.Flags[f.Given]; !ok || g.Given != "" {
+			return fmt.Errorf("%s: given flag %q must be an unconditional flag", name, f.Given)
+		}
+	}
+	for name, f := range map[string]*Favorites{"stated_teams_favorites": p.Stated, "derived_team_rf": p.Derived} {
+		if err := f.compile(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (d *Dist) validate() error {
+	if d.Max <= d.Min {
+		return fmt.Errorf("bad range %v..%v", d.Min, d.Max)
+	}
+	switch d.Type {
+	case DistUniform, DistNormal, DistLogNormal:
+	case DistZipf:
+		if d.S <= 1 {
+			return fmt.Errorf("zipf exponent must be greater than 1")
+		}
+	default:
+		return fmt.Errorf("unknown distribution %q", d.Type)
+	}
+	return nil
+}
+
+func (f *Favorites) compile() error {
+	counts := make(map[string]float64, len(f.Counts))
+	for n, w := range f.Counts {
+		counts[strconv.Itoa(n)] = w
+	}
+	var err error
+	if f.counts, err = newWeighted(counts); err != nil {
+		return fmt.Errorf("counts: %v", err)
+	}
+	for l := range f.Leagues {
+		if _, err := strconv.ParseInt(l, 10, 32); err != nil {
+			return fmt.Errorf("bad league %q", l)
+		}
+		if teamCount(l) == 0 {
+			return fmt.Errorf("unknown league %q", l)
+		}
+	}
+	if f.leagues, err = newWeighted(f.Leagues); err != nil {
+		return fmt.Errorf("leagues: %v", err)
+	}
+	if f.TeamSkew != 0 && f.TeamSkew <= 1 {
+		return fmt.Errorf("team skew must be 0 or greater than 1")
+	}
+	if f.buckets, err = newWeighted(f.Buckets); err != nil {
+		return fmt.Errorf("buckets: %v", err)
+	}
+	return nil
+}
+
+// teamCount returns the number of teams in a league, or 0 if unknown.
+func teamCount(league string) int {
+	for i, l := range leagues {
+		if strconv.Itoa(int(l)) == league {
+			return teamCnt[i]
+		}
+	}
+	return 0
+}
+
+// weighted picks keys with probability proportional to their weight.
+// Keys are sorted so picks depend only on the random source.
+type weighted struct {
+	keys []string
+	cum  []float64
+}
+
+func newWeighted(weights map[string]float64) (*weighted, error) {
+	w := &weighted{}
+	for k := range weights {
+		w.keys = append(w.keys, k)
+	}
+	sort.Strings(w.keys)
+	total := 0.0
+	for _, k := range w.keys {
+		if weights[k] < 0 {
+			return nil, fmt.Errorf("negative weight for %q", k)
+		}
+		total += weights[k]
+		w.cum = append(w.cum, total)
+	}
+	if total <= 0 {
+		return nil, fmt.Errorf("no positive weights")
+	}
+	return w, nil
+}
+
+func (w *weighted) pick(r *rand.Rand) string {
+	x := r.Float64() * w.cum[len(w.cum)-1]
+	i := sort.Search(len(w.cum), func(i int) bool { return w.cum[i] > x })
+	if i == len(w.keys) {
+		i--
+	}
+	return w.keys[i]
+}
+
+// randDist draws an integer from d.
+func (g *Generator) randDist(d *Dist) int {
+	var v float64
+	switch d.Type {
+	case DistUniform:
+		v = d.Min + g.rand.Float64()*(d.Max-d.Min)
+	case DistNormal:
+		v = d.Mean + g.rand.NormFloat64()*d.StdDev
+	case DistLogNormal:
+		v = math.Exp(d.Mu + g.rand.NormFloat64()*d.Sigma)
+	case DistZipf:
+		v = d.Min + float64(g.zipf(d.S, uint64(d.Max-d.Min-1)).Uint64())
+	}
+	return int(math.Max(d.Min, math.Min(math.Floor(v), d.Max-1)))
+}
+
+// zipf returns the zipf generator for s and imax, creating it on first use.
+func (g *Generator) zipf(s float64, imax uint64) *rand.Zipf {
+	key := zipfKey{s: s, imax: imax}
+	z, ok := g.zipfs[key]
+	if !ok {
+		z = rand.NewZipf(g.rand, s, 1, imax)
+		g.zipfs[key] = z
+	}
+	return z
+}
+
+type zipfKey struct {
+	s    float64
+	imax uint64
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/pilosa/pdk"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policies for BSI values outside the range of their field.
+const (
+	// RangeClamp indexes the nearest value in range.
+	RangeClamp = "clamp"
+	// RangeDrop skips the value.
+	RangeDrop = "drop"
+	// RangeDeadLetter skips the value and sends the record to the dead
+	// letter output; the rest of the record is still indexed.
+	RangeDeadLetter = "deadletter"
+)
+
+var valuesOutOfRange = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "loader",
+	Name:      "values_out_of_range_total",
+	Help:      "BSI field values outside the range of their field.",
+}, []string{"frame"})
+
+func init() {
+	prometheus.MustRegister(valuesOutOfRange)
+}
+
+// fieldRange is the range of values a BSI field can hold.
+type fieldRange struct {
+	min, max int64
+}
+
+// Ranges holds the range of every BSI field in the schema, and counts the
+// values found outside them.
+type Ranges struct {
+	policy string
+	fields map[string]map[string]fieldRange
+	// counts is keyed by frame. It is filled in by NewRanges, so that it
+	// can be read without locking.
+	counts map[string]*Counter
+}
+
+// NewRanges returns the ranges of the fields of frames, applying policy to
+// values outside them.
+func NewRanges(frames []pdk.FrameSpec, policy string) (*Ranges, error) {
+	switch policy {
+	case RangeClamp, RangeDrop, RangeDeadLetter:
+	default:
+		return nil, fmt.Errorf("Unknown out of range policy %q, expected %s, %s or %s", policy, RangeClamp, RangeDrop, RangeDeadLetter)
+	}
+	r := &Ranges{
+		policy: policy,
+		fields: make(map[string]map[string]fieldRange),
+		counts: make(map[string]*Counter),
+	}
+	for _, spec := range frames {
+		if len(spec.Fields) == 0 {
+			continue
+		}
+		fields := make(map[string]fieldRange, len(spec.Fields))
+		for _, f := range spec.Fields {
+			fields[f.Name] = fieldRange{min: int64(f.Min), max: int64(f.Max)}
+		}
+		r.fields[spec.Name] = fields
+		r.counts[spec.Name] = &Counter{}
+	}
+	return r, nil
+}
+
+// Count returns the number of values found out of range in frame.
+func (r *Ranges) Count(frame string) int64 {
+	if c, ok := r.counts[frame]; ok {
+		return c.Get()
+	}
+	return 0
+}
+
+// Log logs the number of values found out of range in each frame.
+func (r *Ranges) Log() {
+	var frames []string
+	for frame, c := range r.counts {
+		if c.Get() > 0 {
+			frames = append(frames, frame)
+		}
+	}
+	sort.Strings(frames)
+	for _, frame := range frames {
+		log.Printf("Out of range values in %s: %d (%s)", frame, r.counts[frame].Get(), r.policy)
+	}
+}
+
+// rangeIndexer checks BSI values against their field ranges before
+// passing them on. Each writer uses its own, so the first value rejected
+// from the current record can be kept for the dead letter output.
+type rangeIndexer struct {
+	Indexer
+	ranges *Ranges
+	// rejected describes the first value dropped from the current record
+	// under RangeDeadLetter.
+	rejected error
+}
+
+// reset starts a new record.
+func (i *rangeIndexer) reset() {
+	i.rejected = nil
+}
+
+func (i *rangeIndexer) AddValue(frame, field string, col uint64, val int64) {
+	fr, ok := i.ranges.fields[frame][field]
+	if !ok || (val >= fr.min && val <= fr.max) {
+		i.Indexer.AddValue(frame, field, col, val)
+		return
+	}
+	i.ranges.counts[frame].Add(1)
+	valuesOutOfRange.WithLabelValues(frame).Inc()
+
+	switch i.ranges.policy {
+	case RangeClamp:
+		if val < fr.min {
+			val = fr.min
+		} else {
+			val = fr.max
+		}
+		i.Indexer.AddValue(frame, field, col, val)
+	case RangeDeadLetter:
+		if i.rejected == nil {
+			i.rejected = fmt.Errorf("%s value %d outside %d..%d", frame, val, fr.min, fr.max)
+		}
+	}
+}
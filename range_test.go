@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pilosa/pdk"
+)
+
+func TestRangeIndexer(t *testing.T) {
+	frames := []pdk.FrameSpec{
+		pdk.NewFieldFrameSpec("age_i", 0, 130),
+		pdk.NewRankedFrameSpec("gender", 10),
+	}
+
+	tests := []struct {
+		policy string
+		val    int64
+		// want is the value indexed, if any.
+		want     int64
+		indexed  bool
+		outside  int64
+		rejected string
+	}{
+		{policy: RangeClamp, val: 30, want: 30, indexed: true},
+		{policy: RangeClamp, val: 0, want: 0, indexed: true},
+		{policy: RangeClamp, val: 130, want: 130, indexed: true},
+		{policy: RangeClamp, val: -5, want: 0, indexed: true, outside: 1},
+		{policy: RangeClamp, val: 200, want: 130, indexed: true, outside: 1},
+		{policy: RangeDrop, val: 30, want: 30, indexed: true},
+		{policy: RangeDrop, val: -5, outside: 1},
+		{policy: RangeDrop, val: 200, outside: 1},
+		{policy: RangeDeadLetter, val: 30, want: 30, indexed: true},
+		{policy: RangeDeadLetter, val: -5, outside: 1, rejected: "age_i value -5 outside 0..130"},
+		{policy: RangeDeadLetter, val: 200, outside: 1, rejected: "age_i value 200 outside 0..130"},
+	}
+
+	for _, tt := range tests {
+		ranges, err := NewRanges(frames, tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mem := NewMemoryIndexer()
+		idx := &rangeIndexer{Indexer: mem, ranges: ranges}
+		idx.AddValue("age_i", "age_i", 1, tt.val)
+		// Fields missing from the schema are passed on unchecked.
+		idx.AddValue("extra", "extra", 1, -1)
+
+		v, ok := mem.Value("age_i", "age_i", 1)
+		if ok != tt.indexed || v != tt.want {
+			t.Errorf("%s %d: indexed %d, %v, want %d, %v", tt.policy, tt.val, v, ok, tt.want, tt.indexed)
+		}
+		if v, ok := mem.Value("extra", "extra", 1); !ok || v != -1 {
+			t.Errorf("%s %d: unknown field indexed %d, %v, want -1", tt.policy, tt.val, v, ok)
+		}
+		if n := ranges.Count("age_i"); n != tt.outside {
+			t.Errorf("%s %d: counted %d out of range, want %d", tt.policy, tt.val, n, tt.outside)
+		}
+		var rejected string
+		if idx.rejected != nil {
+			rejected = idx.rejected.Error()
+		}
+		if rejected != tt.rejected {
+			t.Errorf("%s %d: rejected %q, want %q", tt.policy, tt.val, rejected, tt.rejected)
+		}
+		idx.reset()
+		if idx.rejected != nil {
+			t.Errorf("%s %d: reset kept %v", tt.policy, tt.val, idx.rejected)
+		}
+	}
+}
+
+func TestNewRangesPolicy(t *testing.T) {
+	if _, err := NewRanges(nil, "wrap"); err == nil {
+		t.Errorf("unknown policy accepted")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const maxRetryDelay = time.Minute
+
+var errStopped = errors.New("loader stopped")
+
+// backoff returns how long to wait before retry number attempt (from 0),
+// growing exponentially from base with full jitter.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	if d <= 0 || d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryable reports whether a failed open is worth retrying.
+func retryable(err error) bool {
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return false
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		// PreconditionFailed means the object was replaced while it was
+		// being read, so retrying cannot resume it.
+		switch aerr.Code() {
+		case "NoSuchKey", "NoSuchBucket", "AccessDenied", "InvalidRange", "PreconditionFailed":
+			return false
+		}
+	}
+	return true
+}
+
+// objectReader reads an object from a Source, retrying with backoff when
+// opening it fails and reopening it from the last byte read when the body
+// fails mid-stream, so no line is read twice.
+type objectReader struct {
+	m       *Main
+	obj     *Object
+	body    io.ReadCloser
+	offset  int64
+	retries int
+}
+
+// openObject returns a reader over the contents of obj.
+func (m *Main) openObject(obj *Object) (io.ReadCloser, error) {
+	r := &objectReader{m: m, obj: obj}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open (re)opens the object at the current offset, retrying up to the
+// configured number of times.
+func (r *objectReader) open() error {
+	for {
+		body, err := r.m.Source.Open(r.obj, r.offset)
+		if err == nil {
+			r.body = body
+			return nil
+		}
+		if err := r.wait(err); err != nil {
+			return err
+		}
+	}
+}
+
+// wait sleeps before the next attempt after err, or returns err when no
+// attempts remain.
+func (r *objectReader) wait(err error) error {
+	if !retryable(err) || r.retries >= r.m.Retries {
+		return err
+	}
+	d := backoff(r.m.RetryDelay, r.retries)
+	r.retries++
+	log.Printf("Reading %s at byte %d failed, retry %d of %d in %v: %v", r.obj.Key, r.offset, r.retries, r.m.Retries, d, err)
+	select {
+	case <-time.After(d):
+		return nil
+	case <-r.m.stop:
+		return errStopped
+	}
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			// Progress was made, so later failures get a fresh
+			// set of retries.
+			r.retries = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		r.body.Close()
+		r.body = nil
+		if n > 0 {
+			return n, nil
+		}
+		if err := r.wait(err); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *objectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
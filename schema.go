@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pilosa/pdk"
+)
+
+// serverSchema is the part of the Pilosa /schema response holding the
+// ranges of BSI fields.
+type serverSchema struct {
+	Indexes []struct {
+		Name   string `json:"name"`
+		Frames []struct {
+			Name    string `json:"name"`
+			Options struct {
+				Fields []struct {
+					Name string `json:"name"`
+					Min  int64  `json:"min"`
+					Max  int64  `json:"max"`
+				} `json:"fields"`
+			} `json:"options"`
+		} `json:"frames"`
+	} `json:"indexes"`
+}
+
+// checkFieldRanges refuses to load into an existing index whose BSI fields
+// were created with other ranges than frames. Pilosa keeps the range a
+// field was created with, so values outside it, such as the 64-bit swid
+// hashes in an index created when swid held 32-bit hashes, would fail at
+// import.
+func (m *Main) checkFieldRanges(frames []pdk.FrameSpec) error {
+	host := m.Hosts[0]
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(host + "/schema")
+	if err != nil {
+		return fmt.Errorf("Reading schema: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Reading schema: %s", resp.Status)
+	}
+	var schema serverSchema
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		return fmt.Errorf("Reading schema: %v", err)
+	}
+
+	want := make(map[string]pdk.FieldSpec)
+	for _, spec := range frames {
+		for _, f := range spec.Fields {
+			want[spec.Name+"/"+f.Name] = f
+		}
+	}
+	var mismatched []string
+	for _, index := range schema.Indexes {
+		if index.Name != m.IndexName {
+			continue
+		}
+		for _, frame := range index.Frames {
+			for _, f := range frame.Options.Fields {
+				spec, ok := want[frame.Name+"/"+f.Name]
+				if ok && (f.Min != int64(spec.Min) || f.Max != int64(spec.Max)) {
+					mismatched = append(mismatched, fmt.Sprintf("%s/%s is %d..%d, expected %d..%d", frame.Name, f.Name, f.Min, f.Max, spec.Min, spec.Max))
+				}
+			}
+		}
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("Index %s was created with other field ranges (%s); load into a new index, e.g. a new version with -pointer, or delete and reload %s", m.IndexName, strings.Join(mismatched, ", "), m.IndexName)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	u "github.com/travisturner/pilosa-loader/user"
+)
+
+func TestCheckFieldRanges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"indexes":[{"name":"user360","frames":[
+			{"name":"gender","options":{"cacheType":"ranked"}},
+			{"name":"swid","options":{"rangeEnabled":true,"fields":[{"name":"swid","type":"int","min":0,"max":4294967295}]}},
+			{"name":"age_i","options":{"rangeEnabled":true,"fields":[{"name":"age_i","type":"int","min":0,"max":200}]}}]}]}`))
+	}))
+	defer srv.Close()
+
+	m := NewMain()
+	m.Hosts = []string{strings.TrimPrefix(srv.URL, "http://")}
+	m.IndexName = "user360"
+	err := m.checkFieldRanges(u.Frames)
+	if err == nil || !strings.Contains(err.Error(), "swid/swid is 0..4294967295") {
+		t.Errorf("32-bit swid field not refused: %v", err)
+	}
+
+	// A new index has nothing to conflict with.
+	m.IndexName = "user360_20261017"
+	if err := m.checkFieldRanges(u.Frames); err != nil {
+		t.Errorf("new index refused: %v", err)
+	}
+}
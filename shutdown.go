@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pilosa/pdk"
+)
+
+// Exit statuses distinguishing how a load ended.
+const (
+	// exitInterrupted means the load was stopped by a signal after
+	// flushing the indexer and saving the checkpoint.
+	exitInterrupted = 130
+	// exitForced means a second signal ended the load immediately.
+	exitForced = 131
+	// exitAborted means the load was stopped because of bad input or a
+	// file that could not be read, after flushing the indexer and saving
+	// the checkpoint.
+	exitAborted = 3
+)
+
+// handleSignals begins a graceful shutdown on the first SIGINT or SIGTERM
+// and exits immediately on the second.
+func (m *Main) handleSignals() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Printf("Interrupted, shutting down. Bytes processed: %s", pdk.Bytes(m.BytesProcessed()))
+		m.Stop()
+		<-c
+		log.Printf("Interrupted again, exiting immediately. Bytes processed: %s", pdk.Bytes(m.BytesProcessed()))
+		os.Exit(exitForced)
+	}()
+}
+
+// Stop asks the loader to stop reading new data. Objects being read are
+// abandoned at the next line, while records already read are still indexed.
+func (m *Main) Stop() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// Abort stops the loader because of err. Only the first error is kept.
+func (m *Main) Abort(err error) {
+	m.abortOnce.Do(func() {
+		m.abortErr = err
+		log.Printf("Aborting: %v", err)
+		m.Stop()
+	})
+}
+
+// Stopped reports whether Stop has been called.
+func (m *Main) Stopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
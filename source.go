@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Object is a single newline delimited JSON file to be loaded.
+type Object struct {
+	Key  string
+	Size int64
+	// Encoding is the Content-Encoding reported when the object was opened.
+	Encoding string
+	// ETag is the entity tag reported when the object was opened. Ranged
+	// reads resuming the object require it to match, so that the rest of
+	// an object replaced mid-read is not appended to the start of the old
+	// one.
+	ETag string
+}
+
+// Source lists and opens the objects to be loaded.
+type Source interface {
+	// List sends every object available from the source to objs as it
+	// is discovered. It does not close objs.
+	List(objs chan<- *Object) error
+	// Open returns a reader for the contents of obj starting at byte offset.
+	Open(obj *Object, offset int64) (io.ReadCloser, error)
+	String() string
+}
+
+// S3Source reads objects stored under a prefix of an S3 bucket.
+type S3Source struct {
+	svc    *s3.S3
+	Bucket string
+	Prefix string
+}
+
+// NewS3Source returns a Source for the objects under prefix in bucket.
+func NewS3Source(svc *s3.S3, bucket, prefix string) *S3Source {
+	return &S3Source{
+		svc:    svc,
+		Bucket: bucket,
+		Prefix: prefix,
+	}
+}
+
+// List S3 objects from AWS bucket based on command line argument of the bucket name.
+// Listing is paginated with continuation tokens, so prefixes holding more
+// than 1000 keys are listed in full, and each page is sent on as it arrives.
+func (s *S3Source) List(objs chan<- *Object) error {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.Bucket), Prefix: aws.String(s.Prefix)}
+	// Use the commented line to restrict the number of files loaded (for local testing)
+	//input.MaxKeys = aws.Int64(10)
+	err := s.svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			objs <- &Object{Key: aws.StringValue(o.Key), Size: aws.Int64Value(o.Size)}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to list items in bucket %q, %v", s.Bucket, err)
+	}
+	return nil
+}
+
+// Open issues a GetObject request for obj and returns its body. A non-zero
+// offset is requested as a byte range of the version first opened, and
+// fails with PreconditionFailed if the object has since been replaced.
+func (s *S3Source) Open(obj *Object, offset int64) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(obj.Key),
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+		if obj.ETag != "" {
+			input.IfMatch = aws.String(obj.ETag)
+		}
+	}
+	result, err := getObject(s.svc, input)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 {
+		obj.Encoding = aws.StringValue(result.ContentEncoding)
+		obj.ETag = aws.StringValue(result.ETag)
+	}
+	return result.Body, nil
+}
+
+// getObject issues a GetObject request asking for the stored bytes. Without
+// an explicit Accept-Encoding, Go's transport requests gzip and silently
+// decompresses gzip encoded objects, hiding their encoding from decompress
+// and shifting the byte offsets of ranged requests.
+func getObject(svc *s3.S3, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	req, out := svc.GetObjectRequest(input)
+	req.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+	return out, req.Send()
+}
+
+func (s *S3Source) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.Bucket, s.Prefix)
+}
+
+// parseS3URL splits an s3://bucket/prefix URL into its bucket and prefix.
+func parseS3URL(s string) (bucket, prefix string, ok bool) {
+	if !strings.HasPrefix(s, "s3://") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, "s3://"), "/", 2)
+	if len(parts) == 2 {
+		prefix = parts[1]
+	}
+	return parts[0], prefix, parts[0] != ""
+}
+
+// FileSource reads objects from the local filesystem.
+// Each path may name a file, a directory (walked recursively) or a glob
+// pattern such as ./dumps/2026-10-*/part-*.json.
+type FileSource struct {
+	Paths []string
+}
+
+// NewFileSource returns a Source for the given files, directories and globs.
+func NewFileSource(paths []string) *FileSource {
+	return &FileSource{Paths: paths}
+}
+
+// List expands every path and sends the regular files found, in lexical
+// order within each path and without duplicates.
+func (f *FileSource) List(objs chan<- *Object) error {
+	seen := make(map[string]bool)
+	for _, pattern := range f.Paths {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Bad path pattern %q, %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("No files match %q", pattern)
+		}
+		for _, match := range matches {
+			// filepath.Walk visits entries in lexical order.
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if !info.Mode().IsRegular() || seen[path] {
+					return nil
+				}
+				seen[path] = true
+				objs <- &Object{Key: path, Size: info.Size()}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("Unable to list files in %q, %v", match, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Open opens the local file named by obj and seeks to offset.
+func (f *FileSource) Open(obj *Object, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(obj.Key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *FileSource) String() string {
+	return fmt.Sprintf("local files %v", f.Paths)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	u "github.com/travisturner/pilosa-loader/user"
+)
+
+// Stats summarizes what indexing a set of users sets in Pilosa: the number
+// of columns set in each row of each frame, and the count, sum and range of
+// each BSI field. It is written alongside generated data so a load can be
+// checked against Count, TopN and Sum queries.
+type Stats struct {
+	Records int64                       `json:"records"`
+	Bits    map[string]map[uint64]int64 `json:"bits"`
+	Values  map[string]*FieldStats      `json:"values"`
+}
+
+// FieldStats summarizes the values of a BSI field.
+type FieldStats struct {
+	Field string `json:"field"`
+	Count int64  `json:"count"`
+	Sum   int64  `json:"sum"`
+	Min   int64  `json:"min"`
+	Max   int64  `json:"max"`
+}
+
+// NewStats returns empty Stats.
+func NewStats() *Stats {
+	return &Stats{
+		Bits:   make(map[string]map[uint64]int64),
+		Values: make(map[string]*FieldStats),
+	}
+}
+
+// LoadStats reads Stats written by Save.
+func LoadStats(path string) (*Stats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Opening stats: %v", err)
+	}
+	defer f.Close()
+	s := NewStats()
+	if err := json.NewDecoder(f).Decode(s); err != nil {
+		return nil, fmt.Errorf("Parsing stats %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Save writes the stats to path as JSON.
+func (s *Stats) Save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Creating stats: %v", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		f.Close()
+		return fmt.Errorf("Writing stats %s: %v", path, err)
+	}
+	return f.Close()
+}
+
+// Merge adds the stats of a disjoint set of users to s.
+func (s *Stats) Merge(o *Stats) {
+	s.Records += o.Records
+	for frame, rows := range o.Bits {
+		for row, n := range rows {
+			s.addBits(frame, row, n)
+		}
+	}
+	for frame, fs := range o.Values {
+		cur, ok := s.Values[frame]
+		if !ok {
+			c := *fs
+			s.Values[frame] = &c
+			continue
+		}
+		cur.Count += fs.Count
+		cur.Sum += fs.Sum
+		if fs.Min < cur.Min {
+			cur.Min = fs.Min
+		}
+		if fs.Max > cur.Max {
+			cur.Max = fs.Max
+		}
+	}
+}
+
+func (s *Stats) addBits(frame string, row uint64, n int64) {
+	rows, ok := s.Bits[frame]
+	if !ok {
+		rows = make(map[uint64]int64)
+		s.Bits[frame] = rows
+	}
+	rows[row] += n
+}
+
+func (s *Stats) addValue(frame, field string, val int64) {
+	fs, ok := s.Values[frame]
+	if !ok {
+		s.Values[frame] = &FieldStats{Field: field, Count: 1, Sum: val, Min: val, Max: val}
+		return
+	}
+	fs.Count++
+	fs.Sum += val
+	if val < fs.Min {
+		fs.Min = val
+	}
+	if val > fs.Max {
+		fs.Max = val
+	}
+}
+
+type frameRow struct {
+	frame string
+	row   uint64
+}
+
+// statsIndexer is an Indexer tallying the users added to it into Stats.
+// Users are indexed one at a time, so a bit set twice for a user, such as
+// a team listed twice, is only counted once. Values pass through the same
+// range checks as a load, so the stats match what the load indexed.
+type statsIndexer struct {
+	m      *Main
+	stats  *Stats
+	seen   map[frameRow]bool
+	ranged *rangeIndexer
+}
+
+func newStatsIndexer(m *Main, ranges *Ranges) *statsIndexer {
+	i := &statsIndexer{m: m, stats: NewStats(), seen: make(map[frameRow]bool)}
+	i.ranged = &rangeIndexer{Indexer: i, ranges: ranges}
+	return i
+}
+
+// addUser indexes user as the next column.
+func (i *statsIndexer) addUser(user *u.User) {
+	for k := range i.seen {
+		delete(i.seen, k)
+	}
+	i.stats.Records++
+	i.ranged.reset()
+	i.m.indexUser(i.ranged, uint64(i.stats.Records), user)
+}
+
+func (i *statsIndexer) AddBit(frame string, col uint64, row uint64) {
+	k := frameRow{frame: frame, row: row}
+	if i.seen[k] {
+		return
+	}
+	i.seen[k] = true
+	i.stats.addBits(frame, row, 1)
+}
+
+func (i *statsIndexer) AddValue(frame, field string, col uint64, val int64) {
+	i.stats.addValue(frame, field, val)
+}
+
+func (i *statsIndexer) Close() error { return nil }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	swidBucket   = []byte("swids")
+	hashBucket   = []byte("hashes")
+	columnBucket = []byte("columns")
+)
+
+// Collision records two swids which share a swid hash, and so cannot be
+// told apart by querying the swid field.
+type Collision struct {
+	Hash  int64
+	Swids [2]string
+}
+
+// translatorTxSize is the number of swids written per transaction. Bolt
+// only splits pages on commit, so very large transactions slow down.
+const translatorTxSize = 5000
+
+// KeyStore maps user swids to stable Pilosa column IDs.
+type KeyStore interface {
+	// ColumnIDs returns the column ID of each swid, allocating the next
+	// free IDs to swids which have not been seen before.
+	ColumnIDs(swids []string) ([]uint64, error)
+	// Swid returns the swid which was allocated columnID, or false if
+	// the column is not known.
+	Swid(columnID uint64) (string, bool, error)
+	// Collisions returns the swid hash collisions found among the swids
+	// allocated through this KeyStore.
+	Collisions() []Collision
+	Close() error
+}
+
+// OpenKeyStore opens the key store at path, which is either a local key
+// store file or the http:// URL of a key server.
+func OpenKeyStore(path string, readOnly bool) (KeyStore, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return NewKeyClient(path), nil
+	}
+	return OpenTranslator(path, readOnly)
+}
+
+// Translator is a KeyStore kept in an embedded bolt database, so reloading
+// the same users reuses their existing columns. The database is a local
+// file which only one process can open for writing at a time; loaders on
+// several hosts, or several loaders at once, share it through a key server
+// (see keyServerMain). New swids are also checked for collisions of their
+// swid hash.
+//
+// New columns, and the raised sequence, are committed before ColumnIDs
+// returns them, so a column is never given to two swids even if the loader
+// dies before the users are imported.
+type Translator struct {
+	db *bolt.DB
+	// temp is the path of a temporary key store, removed on Close.
+	temp string
+
+	mu         sync.Mutex
+	collisions []Collision
+}
+
+// OpenTranslator opens, creating if necessary, the key store at path.
+// A read only key store can be shared with other readers, and is used to
+// look up swids without allocating columns.
+func OpenTranslator(path string, readOnly bool) (*Translator, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("Opening key store %s: %v", path, err)
+	}
+	t := &Translator{db: db}
+	if readOnly {
+		return t, nil
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{swidBucket, hashBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(columnBucket) != nil {
+			return nil
+		}
+		// Key stores written before reverse lookups were kept are
+		// indexed by column here.
+		cb, err := tx.CreateBucket(columnBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(swidBucket).ForEach(func(k, v []byte) error {
+			return cb.Put(v, k)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Initializing key store %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// OpenTempTranslator opens an empty key store in a temporary file, which is
+// removed on Close, so columns can be allocated without touching the real
+// key store.
+func OpenTempTranslator() (*Translator, error) {
+	f, err := ioutil.TempFile("", "keys")
+	if err != nil {
+		return nil, fmt.Errorf("Creating temporary key store: %v", err)
+	}
+	f.Close()
+	t, err := OpenTranslator(f.Name(), false)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	t.temp = f.Name()
+	return t, nil
+}
+
+// ColumnIDs returns the column ID of each swid, allocating the next free
+// IDs to swids which have not been seen before.
+func (t *Translator) ColumnIDs(swids []string) ([]uint64, error) {
+	ids, collisions, err := t.columnIDs(swids)
+	if len(collisions) > 0 {
+		t.mu.Lock()
+		t.collisions = append(t.collisions, collisions...)
+		t.mu.Unlock()
+	}
+	return ids, err
+}
+
+// columnIDs returns the column ID of each swid and the hash collisions
+// found among the swids it allocated.
+func (t *Translator) columnIDs(swids []string) ([]uint64, []Collision, error) {
+	ids := make([]uint64, len(swids))
+	var missing []int
+	err := t.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(swidBucket)
+		for i, swid := range swids {
+			if v := b.Get([]byte(swid)); v != nil {
+				ids[i] = binary.BigEndian.Uint64(v)
+			} else {
+				missing = append(missing, i)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(missing) == 0 {
+		return ids, nil, err
+	}
+
+	// Sorted keys make for quicker bolt inserts.
+	sort.Slice(missing, func(i, j int) bool { return swids[missing[i]] < swids[missing[j]] })
+	var collisions []Collision
+	for len(missing) > 0 {
+		n := translatorTxSize
+		if n > len(missing) {
+			n = len(missing)
+		}
+		if err := t.allocate(swids, missing[:n], ids, &collisions); err != nil {
+			return nil, collisions, fmt.Errorf("Writing key store: %v", err)
+		}
+		missing = missing[n:]
+	}
+	return ids, collisions, nil
+}
+
+// allocate stores the next free column IDs for swids[i], for each i in
+// missing, in one transaction, and sets them in ids.
+func (t *Translator) allocate(swids []string, missing []int, ids []uint64, collisions *[]Collision) error {
+	return t.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(swidBucket)
+		cb := tx.Bucket(columnBucket)
+		hb := tx.Bucket(hashBucket)
+		// Sequences count the columns allocated, which start at 0.
+		next := b.Sequence()
+		for _, i := range missing {
+			key := []byte(swids[i])
+			// Another writer, or a repeat of the swid in this
+			// batch, may have allocated it since it was looked up.
+			if v := b.Get(key); v != nil {
+				ids[i] = binary.BigEndian.Uint64(v)
+				continue
+			}
+			ids[i] = next
+			id := encodeID(next)
+			next++
+			if err := b.Put(key, id); err != nil {
+				return err
+			}
+			if err := cb.Put(id, key); err != nil {
+				return err
+			}
+			h := encodeID(uint64(swidHash(swids[i])))
+			if other := hb.Get(h); other != nil {
+				*collisions = append(*collisions, Collision{Hash: swidHash(swids[i]), Swids: [2]string{string(other), swids[i]}})
+				continue
+			}
+			if err := hb.Put(h, key); err != nil {
+				return err
+			}
+		}
+		return b.SetSequence(next)
+	})
+}
+
+// Swid returns the swid which was allocated columnID, or false if the
+// column is not known.
+func (t *Translator) Swid(columnID uint64) (string, bool, error) {
+	var swid string
+	var found bool
+	err := t.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(columnBucket)
+		if b == nil {
+			return fmt.Errorf("key store has no column mapping")
+		}
+		if v := b.Get(encodeID(columnID)); v != nil {
+			swid, found = string(v), true
+		}
+		return nil
+	})
+	return swid, found, err
+}
+
+// Collisions returns the swid hash collisions found among new swids.
+func (t *Translator) Collisions() []Collision {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Collision(nil), t.collisions...)
+}
+
+// WriteCollisions writes a tab separated report of swid hash collisions,
+// one pair of swids per line.
+func WriteCollisions(path string, collisions []Collision) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, c := range collisions {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", c.Hash, c.Swids[0], c.Swids[1])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close closes the key store.
+func (t *Translator) Close() error {
+	err := t.db.Close()
+	if t.temp != "" {
+		os.Remove(t.temp)
+	}
+	return err
+}
+
+func encodeID(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
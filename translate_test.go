@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTranslatorColumnIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.db")
+
+	tr, err := OpenTranslator(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := tr.ColumnIDs([]string{"{B}", "{A}", "{B}", "{C}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// New swids are allocated in sorted order, and a repeat gets the
+	// same column.
+	if want := []uint64{1, 0, 1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("columns %v, want %v", ids, want)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Columns and the sequence are stored, so a new run reuses the
+	// columns of known swids and allocates after them.
+	tr, err = OpenTranslator(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	ids, err = tr.ColumnIDs([]string{"{C}", "{D}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{2, 3}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("columns after reopening %v, want %v", ids, want)
+	}
+	if swid, ok, err := tr.Swid(3); err != nil || !ok || swid != "{D}" {
+		t.Errorf("Swid(3) = %q, %v, %v, want {D}", swid, ok, err)
+	}
+}
+
+func TestKeyClient(t *testing.T) {
+	tr, err := OpenTempTranslator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	srv := httptest.NewServer(newKeyHandler(tr))
+	defer srv.Close()
+
+	// Two clients share the key store, as loaders on two hosts would.
+	a, b := NewKeyClient(srv.URL), NewKeyClient(srv.URL+"/")
+	ids, err := a.ColumnIDs([]string{"{A}", "{B}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0, 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("columns %v, want %v", ids, want)
+	}
+	ids, err = b.ColumnIDs([]string{"{C}", "{A}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{2, 0}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("columns from second client %v, want %v", ids, want)
+	}
+
+	if swid, ok, err := a.Swid(2); err != nil || !ok || swid != "{C}" {
+		t.Errorf("Swid(2) = %q, %v, %v, want {C}", swid, ok, err)
+	}
+	if _, ok, err := a.Swid(9); err != nil || ok {
+		t.Errorf("Swid(9) = %v, %v, want not found", ok, err)
+	}
+}
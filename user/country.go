@@ -0,0 +1,87 @@
+package user
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Country is an ISO 3166-1 country. Its numeric code is used as its row
+// in the country frame, so row IDs are stable between loads.
+type Country struct {
+	Alpha2       string
+	Alpha3       string
+	Numeric      uint64
+	Name         string
+	OfficialName string
+}
+
+// Countries is the country table used to resolve Registered_country.
+var Countries = defaultCountries
+
+// countryIndex maps upper cased alpha-2 and alpha-3 codes and names to
+// their country.
+var countryIndex = indexCountries(defaultCountries)
+
+func indexCountries(countries []Country) map[string]Country {
+	idx := make(map[string]Country, 4*len(countries))
+	for _, c := range countries {
+		for _, key := range []string{c.Name, c.OfficialName, c.Alpha3, c.Alpha2} {
+			if key != "" {
+				idx[strings.ToUpper(key)] = c
+			}
+		}
+	}
+	return idx
+}
+
+// LookupCountry resolves an alpha-2 or alpha-3 code or a country name,
+// ignoring case.
+func LookupCountry(s string) (Country, bool) {
+	c, ok := countryIndex[strings.ToUpper(strings.TrimSpace(s))]
+	return c, ok
+}
+
+// LoadCountries replaces the built in country table with a CSV file with
+// the columns alpha-2, alpha-3, numeric code, name and, optionally,
+// official name. A first line starting with alpha2 is skipped as a header.
+func LoadCountries(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Opening country table: %v", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	var countries []Country
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Reading country table %s: %v", path, err)
+		}
+		if line == 1 && strings.EqualFold(rec[0], "alpha2") {
+			continue
+		}
+		if len(rec) < 4 {
+			return fmt.Errorf("Country table %s line %d: expected at least 4 fields, got %d", path, line, len(rec))
+		}
+		num, err := strconv.ParseUint(rec[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Country table %s line %d: bad numeric code: %v", path, line, err)
+		}
+		c := Country{Alpha2: rec[0], Alpha3: rec[1], Numeric: num, Name: rec[3]}
+		if len(rec) > 4 {
+			c.OfficialName = rec[4]
+		}
+		countries = append(countries, c)
+	}
+	Countries = countries
+	countryIndex = indexCountries(countries)
+	return nil
+}
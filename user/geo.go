@@ -0,0 +1,81 @@
+package user
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// GeoScale is the factor coordinates are multiplied by to store them as
+// fixed point integers in the latitude and longitude frames, keeping six
+// decimal places (about 0.1m).
+const GeoScale = 1e6
+
+type latLong struct {
+	lat, long float32
+}
+
+// geoCodes maps a country code and postal code, see geoKey, to the
+// location of the postal code.
+var geoCodes map[string]latLong
+
+func geoKey(country, postalCode string) string {
+	return strings.ToUpper(strings.TrimSpace(country)) + " " + strings.ToUpper(strings.TrimSpace(postalCode))
+}
+
+// LoadGeoCodes loads a postal code gazetteer in the tab separated GeoNames
+// format: country code, postal code, place name, three pairs of admin
+// names and codes, latitude, longitude and accuracy.
+func LoadGeoCodes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Opening gazetteer: %v", err)
+	}
+	defer f.Close()
+
+	codes := make(map[string]latLong)
+	scan := bufio.NewScanner(f)
+	line := 0
+	for scan.Scan() {
+		line++
+		fields := strings.Split(scan.Text(), "\t")
+		if len(fields) < 11 {
+			return fmt.Errorf("Gazetteer %s line %d: expected at least 11 fields, got %d", path, line, len(fields))
+		}
+		lat, err := strconv.ParseFloat(fields[9], 32)
+		if err != nil {
+			return fmt.Errorf("Gazetteer %s line %d: bad latitude: %v", path, line, err)
+		}
+		long, err := strconv.ParseFloat(fields[10], 32)
+		if err != nil {
+			return fmt.Errorf("Gazetteer %s line %d: bad longitude: %v", path, line, err)
+		}
+		codes[geoKey(fields[0], fields[1])] = latLong{lat: float32(lat), long: float32(long)}
+	}
+	if err := scan.Err(); err != nil {
+		return fmt.Errorf("Reading gazetteer %s: %v", path, err)
+	}
+	geoCodes = codes
+	return nil
+}
+
+// GeoCodesLoaded reports whether a gazetteer has been loaded.
+func GeoCodesLoaded() bool {
+	return geoCodes != nil
+}
+
+// GetLatLongFromPostalCode returns the location of a postal code within a
+// country, given by its ISO 3166 alpha-2 code.
+func GetLatLongFromPostalCode(country, postalCode string) (lat, long float32, ok bool) {
+	ll, ok := geoCodes[geoKey(country, postalCode)]
+	return ll.lat, ll.long, ok
+}
+
+// ScaleCoordinate converts a latitude or longitude to its fixed point
+// value, see GeoScale.
+func ScaleCoordinate(v float32) int64 {
+	return int64(math.Round(float64(v) * GeoScale))
+}
@@ -35,6 +35,15 @@ type User struct {
 	Longitude     float32
 	IsRegistered  bool
 	Derived_teams []Favorite `json:"derived_team_rf"`
+
+	// Source is the key of the object the user was read from.
+	Source string `json:"-"`
+	// Raw holds the input line when users are indexed through a mapping
+	// file, or may be sent to the dead letter output.
+	Raw []byte `json:"-"`
+	// Doc holds the decoded record when users are indexed through a mapping
+	// file, in which case the other fields except Swid are not set.
+	Doc interface{} `json:"-"`
 }
 
 type Favorite struct {
@@ -69,7 +78,7 @@ var (
 		pdk.NewRankedFrameSpec("has_autostart", 100),
 		pdk.NewRankedFrameSpec("is_insider", 100),
 
-		pdk.NewFieldFrameSpec("swid", 0, int(math.MaxUint32)),
+		pdk.NewFieldFrameSpec("swid", 0, math.MaxInt64),
 		pdk.NewFieldFrameSpec("page_views", 0, 65535),
 		pdk.NewFieldFrameSpec("time_spent", 0, 10000000),
 		pdk.NewFieldFrameSpec("video_completes", 0, 65535),
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gopilosa "github.com/pilosa/go-pilosa"
+	u "github.com/travisturner/pilosa-loader/user"
+)
+
+// exitMismatch is the exit status of verify when the index does not match.
+const exitMismatch = 4
+
+// verifyBatch is the number of queries sent to Pilosa in one request.
+const verifyBatch = 100
+
+// verifyMain implements the verify subcommand, which checks the index
+// against the stats written by -gen -stats, or recomputed from the source
+// files, with Count, Sum and TopN queries on every frame in user.Frames.
+func verifyMain(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	statsPath := fs.String("stats", "", "Stats file written by -gen -stats, instead of reading the source files.")
+	indexName := fs.String("index", "user360", "Index name.")
+	hosts := fs.String("hosts", "localhost:10101", "Pilosa server hosts as comma separated list.")
+	s3opts := addS3Flags(fs)
+	local := fs.Bool("local", false, "Read local files, directories or glob patterns given as arguments instead of S3.")
+	geocodes := fs.String("geocodes", "", "Postal code gazetteer the load used.")
+	countries := fs.String("countries", "", "CSV country table the load used.")
+	readers := fs.Int("readers", 10, "Number of files read concurrently.")
+	retries := fs.Int("retries", 5, "Number of times to retry reading a file after an error.")
+	topN := fs.Int("topN", 10, "Number of rows checked with TopN in each ranked frame.")
+	outOfRange := fs.String("outOfRange", RangeDrop, "Out of range policy the load used: clamp, drop or deadletter.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [OPTIONS] -stats <file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s verify [OPTIONS] <S3Bucket> <S3Prefix>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s verify [OPTIONS] -local <path|dir|glob>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	m := NewMain()
+	m.Hosts = strings.Split(*hosts, ",")
+	m.IndexName = *indexName
+
+	var stats *Stats
+	var err error
+	if *statsPath != "" {
+		stats, err = LoadStats(*statsPath)
+	} else {
+		if *local && fs.NArg() < 1 {
+			fs.Usage()
+			log.Fatal("At least one local path must be specified.")
+		} else if !*local && fs.NArg() < 2 {
+			fs.Usage()
+			log.Fatal("A stats file, or S3 Bucket and Prefix, must be specified.")
+		}
+		s3opts.apply(m)
+		m.GeoCodesPath = *geocodes
+		m.CountriesPath = *countries
+		m.Readers = *readers
+		m.Retries = *retries
+		m.RetryDelay = time.Second
+		m.OutOfRange = *outOfRange
+		if *local {
+			m.LocalPaths = fs.Args()
+		} else {
+			m.Bucket, m.Prefix = fs.Arg(0), fs.Arg(1)
+		}
+		stats, err = m.sourceStats()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := m.connectPilosa(); err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	failed, err := m.verify(w, stats, *topN)
+	w.Flush()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failed > 0 {
+		log.Printf("FAIL: %d checks did not match", failed)
+		os.Exit(exitMismatch)
+	}
+	log.Printf("PASS: index %s matches %d records", m.IndexName, stats.Records)
+}
+
+// sourceStats reads the source files as a load would, returning the stats
+// of the users indexed. A swid appearing twice is an error, as the load
+// would index both records into one column, which stats cannot follow.
+func (m *Main) sourceStats() (*Stats, error) {
+	if err := m.loadTables(); err != nil {
+		return nil, err
+	}
+	if err := m.openSource(); err != nil {
+		return nil, err
+	}
+	var err error
+	if m.deadLetter, err = NewDeadLetter("", nil); err != nil {
+		return nil, err
+	}
+	// Values are checked against fresh ranges, so the counts of a load
+	// are not added to.
+	ranges, err := NewRanges(u.Frames, m.OutOfRange)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Computing expected stats from %s", m.Source)
+
+	files := make(chan *Object, 2*m.Readers)
+	users := make(chan u.User, 2000)
+	go func() {
+		if err := m.LoadContents(files); err != nil {
+			m.Abort(err)
+		}
+		close(files)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < m.Readers; i++ {
+		wg.Add(1)
+		go func() {
+			for file := range files {
+				m.getUsers(file, users)
+			}
+			wg.Done()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(users)
+	}()
+
+	si := newStatsIndexer(m, ranges)
+	// Swids are remembered by their 64-bit hash, to save memory; the rare
+	// hash collision is reported as a repeat too.
+	seen := make(map[int64]struct{})
+	for user := range users {
+		if m.Stopped() {
+			continue
+		}
+		h := swidHash(user.Swid)
+		if _, ok := seen[h]; ok {
+			m.Abort(fmt.Errorf("Swid %s on line %d of %s has already been seen, expected stats can only be computed when each swid appears once", user.Swid, user.RowNum, user.Source))
+			continue
+		}
+		seen[h] = struct{}{}
+		si.addUser(&user)
+	}
+	if m.abortErr != nil {
+		return nil, m.abortErr
+	}
+	// Stats of part of the source would not match.
+	if m.Stopped() {
+		return nil, errStopped
+	}
+	if n := m.malformed.Get(); n > 0 {
+		log.Printf("Skipped %d malformed lines", n)
+	}
+	return si.stats, nil
+}
+
+// check is a query against the index and the result it should return.
+type check struct {
+	frame    string
+	pql      string
+	expected string
+	// actual formats the result of the query.
+	actual func(*gopilosa.QueryResult) string
+}
+
+// verify runs the checks for every frame in user.Frames, writing a line to
+// w for each frame and each failed check, and returns the number of
+// failed checks.
+func (m *Main) verify(w *bufio.Writer, stats *Stats, topN int) (int, error) {
+	var checks []check
+	for _, spec := range u.Frames {
+		if len(spec.Fields) > 0 {
+			for _, field := range spec.Fields {
+				checks = append(checks, sumCheck(spec.Name, field.Name, stats.Values[spec.Name], hashedFields[spec.Name]))
+			}
+			continue
+		}
+		rows := stats.Bits[spec.Name]
+		checks = append(checks, rowsCheck(spec.Name, rows, int(spec.CacheSize)))
+		checks = append(checks, countChecks(spec.Name, rows)...)
+		if spec.CacheType == gopilosa.CacheTypeRanked && topN > 0 {
+			checks = append(checks, topNCheck(spec.Name, rows, topN))
+		}
+	}
+
+	var failed int
+	checked := make(map[string]int)
+	failures := make(map[string]int)
+	for start := 0; start < len(checks); start += verifyBatch {
+		end := start + verifyBatch
+		if end > len(checks) {
+			end = len(checks)
+		}
+		batch := checks[start:end]
+		var pql bytes.Buffer
+		for _, c := range batch {
+			pql.WriteString(c.pql)
+			pql.WriteByte('\n')
+		}
+		resp, err := m.client.Query(m.index.RawQuery(pql.String()), nil)
+		if err != nil {
+			return failed, fmt.Errorf("Querying %s: %v", m.IndexName, err)
+		}
+		results := resp.Results()
+		if len(results) != len(batch) {
+			return failed, fmt.Errorf("Expected %d results from %s, got %d", len(batch), m.IndexName, len(results))
+		}
+		for i, c := range batch {
+			checked[c.frame]++
+			if actual := c.actual(results[i]); actual != c.expected {
+				failed++
+				failures[c.frame]++
+				fmt.Fprintf(w, "FAIL\t%s\t%s\texpected %s, got %s\n", c.frame, c.pql, c.expected, actual)
+			}
+		}
+	}
+
+	for _, spec := range u.Frames {
+		status := "PASS"
+		if failures[spec.Name] > 0 {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d of %d checks passed\n", status, spec.Name, checked[spec.Name]-failures[spec.Name], checked[spec.Name])
+	}
+	return failed, nil
+}
+
+// hashedFields are the BSI frames holding hashes, whose sums overflow.
+var hashedFields = map[string]bool{"swid": true, "postal_code": true}
+
+// sumCheck checks the count and sum of the values of a BSI field, or only
+// the count when countOnly is set.
+func sumCheck(frame, field string, fs *FieldStats, countOnly bool) check {
+	if fs == nil {
+		fs = &FieldStats{}
+	}
+	if countOnly {
+		return check{
+			frame:    frame,
+			pql:      fmt.Sprintf("Sum(frame=%q, field=%q)", frame, field),
+			expected: fmt.Sprintf("count=%d", fs.Count),
+			actual: func(r *gopilosa.QueryResult) string {
+				return fmt.Sprintf("count=%d", r.Count)
+			},
+		}
+	}
+	return check{
+		frame:    frame,
+		pql:      fmt.Sprintf("Sum(frame=%q, field=%q)", frame, field),
+		expected: fmt.Sprintf("count=%d sum=%d", fs.Count, fs.Sum),
+		actual: func(r *gopilosa.QueryResult) string {
+			return fmt.Sprintf("count=%d sum=%d", r.Count, r.Sum)
+		},
+	}
+}
+
+// countChecks checks the number of columns in each expected row of a frame.
+func countChecks(frame string, rows map[uint64]int64) []check {
+	var checks []check
+	for _, row := range sortedRows(rows) {
+		checks = append(checks, check{
+			frame:    frame,
+			pql:      fmt.Sprintf("Count(Bitmap(frame=%q, rowID=%d))", frame, row),
+			expected: fmt.Sprint(rows[row]),
+			actual: func(r *gopilosa.QueryResult) string {
+				return fmt.Sprint(r.Count)
+			},
+		})
+	}
+	return checks
+}
+
+// rowsCheck checks that a frame holds exactly the expected rows, using
+// TopN to list the rows in its cache. When there are more expected rows
+// than the cache holds, only rows missing from the expectation are found.
+func rowsCheck(frame string, rows map[uint64]int64, cacheSize int) check {
+	n := len(rows) + 1
+	if cacheSize > 0 && n > cacheSize {
+		n = cacheSize
+	}
+	want := len(rows)
+	if want > n {
+		want = n
+	}
+	return check{
+		frame:    frame,
+		pql:      fmt.Sprintf("TopN(frame=%q, n=%d)", frame, n),
+		expected: fmt.Sprintf("%d rows", want),
+		actual: func(r *gopilosa.QueryResult) string {
+			for _, item := range r.CountItems {
+				if _, ok := rows[item.ID]; !ok {
+					return fmt.Sprintf("unexpected row %d with count %d", item.ID, item.Count)
+				}
+			}
+			return fmt.Sprintf("%d rows", len(r.CountItems))
+		},
+	}
+}
+
+// topNCheck checks that the top n rows of a ranked frame are rows with the
+// expected counts. Rows tied on count may be returned in any order, so
+// only the counts are compared.
+func topNCheck(frame string, rows map[uint64]int64, n int) check {
+	counts := make([]int64, 0, len(rows))
+	for _, c := range rows {
+		counts = append(counts, c)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] > counts[j] })
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return check{
+		frame:    frame,
+		pql:      fmt.Sprintf("TopN(frame=%q, n=%d)", frame, n),
+		expected: fmt.Sprint(counts),
+		actual: func(r *gopilosa.QueryResult) string {
+			got := make([]int64, 0, len(r.CountItems))
+			for _, item := range r.CountItems {
+				if want, ok := rows[item.ID]; !ok || want != int64(item.Count) {
+					return fmt.Sprintf("row %d with count %d", item.ID, item.Count)
+				}
+				got = append(got, int64(item.Count))
+			}
+			return fmt.Sprint(got)
+		},
+	}
+}
+
+func sortedRows(rows map[uint64]int64) []uint64 {
+	ids := make([]uint64, 0, len(rows))
+	for id := range rows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}